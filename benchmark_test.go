@@ -0,0 +1,45 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// BenchmarkTransfer sends a file between two ends in this process over loopback, once over
+// one connection and once over four. Loopback takes the network out of it, so what's left is
+// disk, crypto, and the transfer pipeline itself. Run it with
+// `go test -tags nogui -run - -bench Transfer`.
+
+const benchmarkSize = 64 * 1000000
+
+func BenchmarkTransfer(b *testing.B) {
+	dir := b.TempDir()
+	src := filepath.Join(dir, "src", "benchmark.bin")
+	if _, err := writeRandomFile(src, benchmarkSize); err != nil {
+		b.Fatal(err)
+	}
+	for _, streams := range []int{1, 4} {
+		b.Run(fmt.Sprintf("streams=%d", streams), func(b *testing.B) {
+			b.SetBytes(benchmarkSize)
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				dest := filepath.Join(dir, fmt.Sprintf("dest%d", streams))
+				if err := os.Mkdir(dest, 0755); err != nil {
+					b.Fatal(err)
+				}
+				p := newTestPair([]string{src}, dest)
+				p.sender.Streams = streams
+				b.StartTimer()
+				if err := checkBothSucceeded(p.run()); err != nil {
+					b.Fatal(err)
+				}
+				b.StopTimer()
+				os.RemoveAll(dest)
+				b.StartTimer()
+			}
+		})
+	}
+}
@@ -1,299 +1,479 @@
 package main
 
 import (
-	"crypto/md5"
+	"bytes"
+	"crypto/sha256"
 	"encoding/binary"
-	"errors"
 	"fmt"
-	"github.com/dontpanic92/wxGo/wx"
 	"io"
 	"net"
 	"os"
 	"path/filepath"
+	"sync/atomic"
 	"time"
 )
 
 const CHUNKSIZE = 1000000 // 1MB
 
+// limits on lengths read off the wire, so a corrupt stream can't make us allocate wildly
+const maxFilenameLen = 4096
+const maxChunkSize = CHUNKSIZE + 1024 // room for nonce and authenticator
+
+// how long the sending end waits for the receiving end to check a file, get it onto disk,
+// and acknowledge it. Tests shorten it.
+var ackTimeout = 2 * time.Minute
+
 func chunkAndSend(pConn *net.Conn, t *Transfer) error {
 	start := time.Now()
 	conn := *pConn
 
 	file, err := os.Open(t.Filepath)
 	if err != nil {
-		return errors.New("Error opening out file. Please quit and restart Flying Carpet.")
+		return newTransferError(errLocalIO, "Error opening out file:", err)
 	}
 	defer file.Close()
+	fileInfo, err := file.Stat()
+	if err != nil {
+		return newTransferError(errLocalIO, "Error reading out file:", err)
+	}
 
-	showProgressBar(t)
-	fileSize := getSize(file)
-	t.output(fmt.Sprintf("File size: %s\nMD5 hash: %x", makeSizeReadable(fileSize), getHash(t.Filepath)))
-	numChunks := ceil(fileSize, CHUNKSIZE)
+	t.UI.FileStarted(t.Filepath)
+	fileSize := fileInfo.Size()
+	t.output(fmt.Sprintf("File size: %s", makeSizeReadable(fileSize)))
 
-	bytesLeft := fileSize
-	var i int64
+	progress := &fileProgress{bytesLeft: fileSize}
 
 	ticker := time.NewTicker(time.Millisecond * 1000)
+	defer ticker.Stop()
 	go func() {
 		for _ = range ticker.C {
 			select {
 			case <-t.Ctx.Done():
 				return
 			default:
-				percentDone := 100 * float64(float64(fileSize)-float64(bytesLeft)) / float64(fileSize)
-				updateProgressBar(int(percentDone), t)
+				percentDone := 100 * float64(fileSize-progress.left()) / float64(fileSize)
+				t.UI.Progress(int(percentDone))
 			}
 		}
 	}()
 
-	// transmit filename and size
-	filename := filepath.Base(t.Filepath)
-	filenameLen := int64(len(filename))
-	err = binary.Write(conn, binary.BigEndian, filenameLen)
-	if err != nil {
-		return fmt.Errorf("Error writing filename length: %s\n Please quit and restart Flying Carpet.", err)
+	// transmit filename, size, and metadata
+	if err = sendHeader(conn, t, t.RelPath, fileSize, readMetadata(t, t.Filepath, fileInfo)); err != nil {
+		return err
 	}
-	_, err = conn.Write([]byte(filename))
-	if err != nil {
-		return fmt.Errorf("Error writing filename: %s\n Please quit and restart Flying Carpet.", err)
+
+	// receiving end tells us how much of the file it already has from an interrupted transfer
+	hasher := newFileHasher()
+	var resumeOffset int64
+	if t.hasCapability(capResume) {
+		if resumeOffset, err = negotiateResume(conn, t, file, fileSize, hasher); err != nil {
+			return err
+		}
 	}
-	err = binary.Write(conn, binary.BigEndian, fileSize)
-	if err != nil {
-		return fmt.Errorf("Error transmitting file size: %s\n Please quit and restart Flying Carpet.", err)
+	if resumeOffset > 0 {
+		atomic.AddInt64(&progress.bytesLeft, -resumeOffset)
+		t.output(fmt.Sprintf("Receiving end already has %s, resuming.", makeSizeReadable(resumeOffset)))
 	}
+	numChunks := ceil(progress.left(), CHUNKSIZE)
 	/////////////////////////////
 
-	for i = 0; i < numChunks; i++ {
-		select {
-		case <-t.Ctx.Done():
-			return errors.New("Exiting chunkAndSend, transfer was canceled.")
-		default:
-			bufferSize := min(CHUNKSIZE, bytesLeft)
-			buffer := make([]byte, bufferSize)
-			bytesRead, err := file.Read(buffer)
-			if int64(bytesRead) != bufferSize {
-				return fmt.Errorf("bytesRead: %d\nbufferSize: %d\nError reading out file. Please quit and restart Flying Carpet.", bytesRead, bufferSize)
-			}
-			bytesLeft -= bufferSize
-
-			// encrypt buffer
-			encryptedBuffer := encrypt(buffer, t.Passphrase)
-
-			// send size of buffer
-			chunkSize := int64(len(encryptedBuffer))
-			err = binary.Write(conn, binary.BigEndian, chunkSize)
-			if err != nil {
-				return errors.New("Error writing chunk length. Please quit and restart Flying Carpet. " + err.Error())
-			}
-
-			// send buffer
-			bytes, err := conn.Write(encryptedBuffer)
-			if bytes != len(encryptedBuffer) {
-				return errors.New("Send error. Please quit and restart Flying Carpet. " + err.Error())
-			}
+	// read, compress if it's worth it, encrypt, and send, each stage in its own goroutine
+	compress := worthCompressing(t, t.Filepath)
+	if len(t.StreamConns) > 0 && numChunks > 0 {
+		err = sendChunksParallel(t, file, resumeOffset, fileSize, compress, hasher, progress)
+	} else {
+		err = sendChunks(conn, t, file, resumeOffset, fileSize, compress, hasher, progress)
+	}
+	if err != nil {
+		return err
+	}
+	// send hashes so the receiving end can check what it got
+	if t.hasCapability(capIntegrity) {
+		if err = writeFrame(conn, frameTrailer, hasher.trailer()); err != nil {
+			return streamError("Error transmitting file hash:", err)
 		}
 	}
-	// send chunkSize of 0 and then wait until receiving end tells us they have everything.
-	binary.Write(conn, binary.BigEndian, int64(0))
+	t.output(fmt.Sprintf("SHA-256 hash: %x", hasher.fileHash()))
 
-	// timeout for binary.Read
-	replyChan := make(chan int64)
-	timeoutChan := make(chan int)
-	go func() {
-		var comp int64
-		binary.Read(conn, binary.BigEndian, &comp)
-		replyChan <- comp
-	}()
-	go func() {
-		time.Sleep(time.Second * 2)
-		timeoutChan <- 0
-	}()
-	select {
-	case /*comp :=*/ <-replyChan:
-		// t.output(fmt.Sprintf("Receiving end says: %d", comp))
-	case <-timeoutChan:
-		t.output("Receiving end did not acknowledge but should have received signal to close connection.")
+	// signal end of file and then wait until receiving end tells us they have everything.
+	if err = writeFrame(conn, frameEnd, nil); err != nil {
+		return streamError("Error signalling end of file:", err)
+	}
+
+	clear := readDeadline(t.Ctx, conn, ackTimeout)
+	ack, err := expectFrame(conn, frameAck, "acknowledgement")
+	clear()
+	if err != nil {
+		return t.canceled(err, "chunkAndSend")
+	}
+	if len(ack) != 1 || ack[0] > ackSaveFailed {
+		return newTransferError(errTamperedChunk, "Received malformed acknowledgement.", nil)
+	}
+	switch ack[0] {
+	case ackIntegrityFailed:
+		return newTransferError(errTamperedChunk, "Receiving end could not verify the file it received against this end's hash.", nil)
+	case ackSaveFailed:
+		return fmt.Errorf("Receiving end could not save %s.", t.RelPath)
 	}
 
 	//////////
 
 	ticker.Stop()
-	updateProgressBar(100, t)
+	t.UI.Progress(100)
 	t.output(fmt.Sprintf("Sending took %s", time.Since(start)))
+	reportSpeed(t, fileSize-resumeOffset, progress, time.Since(start))
+	t.UI.FileFinished(t.Filepath)
 	return nil
 }
 
-func receiveAndAssemble(pConn *net.Conn, t *Transfer) error {
+// negotiateResume finds out where the receiving end wants to pick up the file and seeks there.
+// If both ends can check integrity, the part the receiving end already has is hashed here and
+// compared to its Merkle root first, and the file starts over if they don't match.
+func negotiateResume(conn net.Conn, t *Transfer, file *os.File, fileSize int64, hasher *fileHasher) (int64, error) {
+	request, err := expectFrame(conn, frameResume, "resume offset")
+	if err != nil {
+		return 0, err
+	}
+	if len(request) < 8 {
+		return 0, newTransferError(errTamperedChunk, "Received malformed resume offset.", nil)
+	}
+	offset := int64(binary.BigEndian.Uint64(request))
+	if offset < 0 || offset > fileSize || offset%CHUNKSIZE != 0 && offset != fileSize {
+		return 0, newTransferError(errTamperedChunk, fmt.Sprintf("Receiving end asked to resume at invalid offset %d.", offset), nil)
+	}
+	if !t.hasCapability(capIntegrity) {
+		if _, err = file.Seek(offset, io.SeekStart); err != nil {
+			return 0, newTransferError(errLocalIO, "Error seeking in out file:", err)
+		}
+		return offset, nil
+	}
+
+	if offset > 0 {
+		if len(request) != 8+sha256.Size {
+			return 0, newTransferError(errTamperedChunk, "Received malformed resume offset.", nil)
+		}
+		buffer := make([]byte, CHUNKSIZE)
+		for read := int64(0); read < offset; {
+			n, err := io.ReadFull(file, buffer[:min(CHUNKSIZE, offset-read)])
+			if err != nil {
+				return 0, newTransferError(errLocalIO, "Error reading out file:", err)
+			}
+			hasher.add(buffer[:n])
+			read += int64(n)
+		}
+		if !bytes.Equal(merkleRoot(hasher.chunks), request[8:]) {
+			t.output("Partial file on receiving end doesn't match this one, starting over.")
+			offset = 0
+			*hasher = *newFileHasher()
+			if _, err = file.Seek(0, io.SeekStart); err != nil {
+				return 0, newTransferError(errLocalIO, "Error seeking in out file:", err)
+			}
+		}
+	}
+	if err = writeInt64Frame(conn, frameResume, offset); err != nil {
+		return 0, streamError("Error confirming resume offset:", err)
+	}
+	return offset, nil
+}
+
+// receiveAndAssemble receives the next file or folder. If the sending end sent a manifest,
+// expected is the entry from it that should come next. The file is written under a temporary
+// name next to where it belongs, and only renamed once it's complete and verified, so a file
+// with the real name is never a partial one.
+func receiveAndAssemble(pConn *net.Conn, t *Transfer, expected *manifestEntry) (err error) {
 	start := time.Now()
 	conn := *pConn
 
-	// receive filename and size
-	var filenameLen int64
-	err := binary.Read(conn, binary.BigEndian, &filenameLen)
+	// receive filename, size, and metadata
+	filename, fileSize, meta, err := receiveHeader(conn, t)
 	if err != nil {
-		return fmt.Errorf("Error receiving filename length: %s\nPlease quit and restart Flying Carpet.", err)
+		return err
 	}
-	filenameBytes := make([]byte, filenameLen)
-	_, err = io.ReadFull(conn, filenameBytes)
-	if err != nil {
-		return fmt.Errorf("Error receiving filename: %s\nPlease quit and restart Flying Carpet.", err)
+	if expected != nil && (filename != expected.RelPath || fileSize != expected.Size || meta.Mode.IsDir() != expected.Mode.IsDir()) {
+		return newTransferError(errTamperedChunk, fmt.Sprintf("Sending end sent %q, which isn't what was accepted.", filename), nil)
 	}
-	filename := string(filenameBytes)
-	var fileSize int64
-	err = binary.Read(conn, binary.BigEndian, &fileSize)
+	outPath, err := safeJoin(t.Destination, filename)
 	if err != nil {
-		return fmt.Errorf("Error receiving file size: %s\nPlease quit and restart Flying Carpet.", err)
+		return err
+	}
+	if meta.Mode.IsDir() {
+		return receiveDirectory(t, outPath, meta.Mode)
+	}
+	if err = os.MkdirAll(filepath.Dir(outPath), 0755); err != nil {
+		return newTransferError(errLocalIO, "Error creating folder:", err)
 	}
 
-	// if t.Filepath is not a directory, we're in a multifile transfer (as start button action in gui.go
-	// would've made it a directory for the first transfer), so we need to reset it to be a directory.
-	fpStat, err := os.Stat(t.Filepath)
-	if err != nil {
-		return errors.New("Error accessing destination folder: " + err.Error())
+	// pick where the file goes: where the sending end said, unless something's already there,
+	// and then according to the conflict policy. without a manifest there's no skipping, since
+	// the file's coming anyway. if a previous transfer of this file was interrupted and its
+	// partial file kept, pick up where it left off.
+	policy := t.OnConflict
+	if expected != nil {
+		policy = expected.onConflict
+	}
+	finalPath, replacing := placeFile(outPath, policy)
+	writingPath := finalPath + partSuffix
+	t.Filepath = writingPath
+	var j *journal
+	var resuming bool
+	if t.hasCapability(capResume) {
+		j, resuming = loadJournal(t.Filepath, fileSize)
 	}
-	if !fpStat.IsDir() {
-		t.Filepath = filepath.Dir(t.Filepath) + string(os.PathSeparator)
+	if resuming {
+		defer j.close()
+	}
+	if finalPath != outPath {
+		t.output(fmt.Sprintf("%s is already here, saving as %s.", filename, filepath.Base(finalPath)))
 	}
 
-	// now check if file being received already exists. if so, append t.SSID to front end.
-	if _, err := os.Stat(t.Filepath + filename); err != nil {
-		t.Filepath += filename
+	t.output(fmt.Sprintf("Filename: %s\nFile size: %s", filename, makeSizeReadable(fileSize)))
+	t.UI.FileStarted(finalPath)
+
+	var outFile *os.File
+	hasher := newFileHasher()
+	if resuming {
+		outFile, err = os.OpenFile(t.Filepath, os.O_RDWR, 0666)
+		if err != nil {
+			return newTransferError(errLocalIO, "Error reopening partial file:", err)
+		}
+		if err = verifyPartial(outFile, j, hasher); err != nil {
+			outFile.Close()
+			return err
+		}
 	} else {
-		t.Filepath = t.Filepath + t.SSID + "_" + filename
+		outFile, err = os.OpenFile(t.Filepath, os.O_CREATE|os.O_RDWR|os.O_TRUNC, 0666)
+		if err != nil {
+			return newTransferError(errLocalIO, "Error creating out file:", err)
+		}
+		if j, err = newJournal(t.Filepath, fileSize); err != nil {
+			outFile.Close()
+			return err
+		}
+		defer j.close()
+	}
+	defer outFile.Close()
+
+	// if the transfer fails from here on, keep what's been received to resume from, or not
+	defer func() {
+		if err != nil && !(t.KeepPartial && t.hasCapability(capResume)) {
+			outFile.Close()
+			j.remove()
+			os.Remove(writingPath)
+		}
+	}()
+
+	// tell sending end where to start, and if it can check, what we have so far so it can
+	// confirm
+	var resumeOffset int64
+	if t.hasCapability(capResume) {
+		resumeOffset = j.resumeOffset()
+		request := make([]byte, 8)
+		binary.BigEndian.PutUint64(request, uint64(resumeOffset))
+		if t.hasCapability(capIntegrity) && resumeOffset > 0 {
+			request = append(request, merkleRoot(hasher.chunks)...)
+		}
+		if err = writeFrame(conn, frameResume, request); err != nil {
+			return streamError("Error transmitting resume offset:", err)
+		}
+		if t.hasCapability(capIntegrity) {
+			confirmed, err := expectInt64Frame(conn, frameResume, "resume confirmation")
+			if err != nil {
+				return err
+			}
+			if confirmed != resumeOffset {
+				if confirmed != 0 {
+					return newTransferError(errTamperedChunk, fmt.Sprintf("Sending end confirmed invalid resume offset %d.", confirmed), nil)
+				}
+				t.output("Partial file doesn't match the one being sent, starting over.")
+				resumeOffset = 0
+				hasher = newFileHasher()
+				if err = j.truncate(0); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	if err = outFile.Truncate(resumeOffset); err != nil {
+		return newTransferError(errLocalIO, "Error preparing out file:", err)
+	}
+	if _, err = outFile.Seek(resumeOffset, io.SeekStart); err != nil {
+		return newTransferError(errLocalIO, "Error preparing out file:", err)
+	}
+	if resumeOffset > 0 {
+		t.output(fmt.Sprintf("Resuming interrupted transfer at %s.", makeSizeReadable(resumeOffset)))
 	}
 
-	t.output(fmt.Sprintf("Filename: %s\nFile size: %s", filename, makeSizeReadable(fileSize)))
-	updateFilename(t)
 	// progress bar
-	showProgressBar(t)
-	bytesLeft := fileSize
+	progress := &fileProgress{bytesLeft: fileSize - resumeOffset}
 	ticker := time.NewTicker(time.Millisecond * 1000)
+	defer ticker.Stop()
 	go func() {
 		for _ = range ticker.C {
 			select {
 			case <-t.Ctx.Done():
 				return
 			default:
-				percentDone := 100 * float64(float64(fileSize)-float64(bytesLeft)) / float64(fileSize)
-				updateProgressBar(int(percentDone), t)
+				percentDone := 100 * float64(fileSize-progress.left()) / float64(fileSize)
+				t.UI.Progress(int(percentDone))
 			}
 		}
 	}()
 	/////////////////////////////
 
-	outFile, err := os.OpenFile(t.Filepath, os.O_CREATE|os.O_RDWR, 0666)
+	// receive, decrypt, and write, each stage in its own goroutine. with data streams, only
+	// the trailer and end of file come over conn.
+	if len(t.StreamConns) > 0 && progress.left() > 0 {
+		if err = receiveChunksParallel(t, outFile, resumeOffset, fileSize, j, hasher, progress); err != nil {
+			return err
+		}
+	}
+	trailer, err := receiveChunks(conn, t, outFile, j, hasher, progress)
 	if err != nil {
-		return errors.New("Error creating out file. Please quit and restart Flying Carpet.")
+		return err
 	}
-	defer outFile.Close()
 
-	var chunkSize int64
-outer:
-	for {
-		select {
-		case <-t.Ctx.Done():
-			return errors.New("Exiting dialPeer, transfer was canceled.")
-		default:
-			// get chunk size
-			chunkSize = -1
-			err := binary.Read(conn, binary.BigEndian, &chunkSize)
-			if err != nil || chunkSize == -1 {
-				return errors.New("Error reading chunk size: " + err.Error())
-			}
-			if chunkSize == 0 {
-				// done receiving
-				break outer
-			}
-
-			// get chunk
-			chunk := make([]byte, chunkSize)
-			bytesReceived, err := io.ReadFull(conn, chunk)
-			if err != nil {
-				return errors.New("Error reading from stream: " + err.Error())
-			}
-			// t.output(fmt.Sprintf("read %d bytes", bytesReceived))
-			if int64(bytesReceived) != chunkSize {
-				return fmt.Errorf("bytesReceived: %d\nchunkSize: %d", bytesReceived, chunkSize)
-			}
-
-			// decrypt and add to outfile
-			decryptedChunk := decrypt(chunk, t.Passphrase)
-			_, err = outFile.Write(decryptedChunk)
-			if err != nil {
-				return errors.New("Error writing to out file. Please quit and restart Flying Carpet.")
-			}
-			bytesLeft -= int64(len(decryptedChunk))
-		}
+	// make sure we got what was sent
+	if t.hasCapability(capIntegrity) && !hasher.matches(trailer) {
+		writeFrame(conn, frameAck, []byte{ackIntegrityFailed})
+		outFile.Close()
+		j.remove()
+		quarantine(t, writingPath, finalPath)
+		return newTransferError(errTamperedChunk, "Received file does not match the sending end's hash.", nil)
+	}
+	// make sure it's all on disk before it gets its real name, replacing whatever had it, and
+	// that the new name is on disk too. the sending end only counts the file as sent once it is.
+	if err = outFile.Sync(); err != nil {
+		writeFrame(conn, frameAck, []byte{ackSaveFailed})
+		return newTransferError(errLocalIO, "Error writing to out file:", err)
+	}
+	outFile.Close()
+	if err = os.Rename(writingPath, finalPath); err != nil {
+		writeFrame(conn, frameAck, []byte{ackSaveFailed})
+		return newTransferError(errLocalIO, "Error moving received file into place:", err)
+	}
+	if err = syncDir(filepath.Dir(finalPath)); err != nil {
+		writeFrame(conn, frameAck, []byte{ackSaveFailed})
+		return newTransferError(errLocalIO, "Error moving received file into place:", err)
+	}
+	writeFrame(conn, frameAck, []byte{ackOK})
+	t.Filepath = finalPath
+	j.remove()
+	applyMetadata(t, finalPath, meta)
+	if replacing {
+		t.output("Replaced " + finalPath)
 	}
-
-	// wait till we've received everything before signalling to other end that it's okay to stop sending.
-	binary.Write(conn, binary.BigEndian, int64(1))
 
 	ticker.Stop()
-	updateProgressBar(100, t)
-	t.output(fmt.Sprintf("Received file size: %s", makeSizeReadable(getSize(outFile))))
-	t.output(fmt.Sprintf("Received file hash: %x", getHash(t.Filepath)))
+	t.UI.Progress(100)
+	t.output(fmt.Sprintf("Received file size: %s", makeSizeReadable(fileSize)))
+	if t.hasCapability(capIntegrity) {
+		t.output(fmt.Sprintf("Received file SHA-256 hash: %x (verified)", hasher.fileHash()))
+	} else {
+		t.output(fmt.Sprintf("Received file SHA-256 hash: %x", hasher.fileHash()))
+	}
 	t.output(fmt.Sprintf("Receiving took %s", time.Since(start)))
+	t.UI.FileFinished(t.Filepath)
 
-	speed := (float64(getSize(outFile)*8) / 1000000) / (float64(time.Since(start)) / 1000000000)
-	t.output(fmt.Sprintf("Speed: %.2fmbps", speed))
-	return err
+	reportSpeed(t, fileSize-resumeOffset, progress, time.Since(start))
+	return nil
 }
 
-func sendCount(pConn *net.Conn, t *Transfer) error {
-	conn := *pConn
-	numFiles := int64(len(t.FileList))
-	err := binary.Write(conn, binary.BigEndian, numFiles)
-	if err != nil {
-		return fmt.Errorf("Error transmitting number of files: %s\n Please quit and restart Flying Carpet.", err)
+// verifyPartial re-reads the part of a partial file that the journal says was written, checking
+// each chunk against its recorded hash. The journal is cut back to the last chunk that checks out,
+// and the hasher picks up everything before that so the whole-file hash comes out right.
+func verifyPartial(outFile *os.File, j *journal, hasher *fileHasher) error {
+	buffer := make([]byte, CHUNKSIZE)
+	good := 0
+	for ; good < len(j.hashes); good++ {
+		size := min(CHUNKSIZE, j.fileSize-int64(good)*CHUNKSIZE)
+		if _, err := io.ReadFull(outFile, buffer[:size]); err != nil {
+			break
+		}
+		sum := sha256.Sum256(buffer[:size])
+		if !bytes.Equal(sum[:], j.hashes[good]) {
+			break
+		}
+		hasher.add(buffer[:size])
 	}
-	return err
+	return j.truncate(good)
 }
 
-func receiveCount(pConn *net.Conn, t *Transfer) (int, error) {
-	conn := *pConn
-	var numFiles int64
-	err := binary.Read(conn, binary.BigEndian, &numFiles)
+// sendDirectory tells the receiving end to create a directory. Directories are sent before anything
+// inside them, so this is how empty ones and their permissions make it across.
+func sendDirectory(pConn *net.Conn, t *Transfer) error {
+	info, err := os.Stat(t.Filepath)
 	if err != nil {
-		return 0, fmt.Errorf("Error receiving number of files: %s\nPlease quit and restart Flying Carpet.", err)
+		return newTransferError(errLocalIO, "Error reading folder:", err)
 	}
-	return int(numFiles), nil
+	return sendHeader(*pConn, t, t.RelPath, 0, fileMetadata{Mode: info.Mode() & (os.ModeDir | os.ModePerm)})
 }
 
-func getSize(file *os.File) (size int64) {
-	fileInfo, _ := file.Stat()
-	size = fileInfo.Size()
-	return
+func receiveDirectory(t *Transfer, outPath string, mode os.FileMode) error {
+	t.output("Creating folder " + outPath)
+	if err := os.MkdirAll(outPath, mode.Perm()|0700); err != nil {
+		return newTransferError(errLocalIO, "Error creating folder:", err)
+	}
+	return nil
 }
 
-func getHash(filepath string) (md5hash []byte) {
-	file, err := os.Open(filepath)
-	if err != nil {
-		panic(err)
+// sendHeader transmits the per-file header frame: file mode, size, the rest of the file's
+// metadata if the peer takes it, and relative path.
+func sendHeader(conn net.Conn, t *Transfer, relPath string, size int64, meta fileMetadata) error {
+	header := make([]byte, 16, 16+len(relPath))
+	binary.BigEndian.PutUint64(header[0:], uint64(meta.Mode))
+	binary.BigEndian.PutUint64(header[8:], uint64(size))
+	if t.hasCapability(capMetadata) {
+		header = append(header, encodeMetadata(meta)...)
 	}
-	hash := md5.New()
-	if _, err := io.Copy(hash, file); err != nil {
-		panic(err)
+	header = append(header, relPath...)
+	if err := writeFrame(conn, frameHeader, header); err != nil {
+		return streamError("Error transmitting file header:", err)
 	}
-	md5hash = hash.Sum(nil)
-	return
+	return nil
 }
 
-func updateProgressBar(percentage int, t *Transfer) {
-	progressEvt := wx.NewThreadEvent(wx.EVT_THREAD, progressBarUpdate)
-	progressEvt.SetInt(percentage)
-	t.Frame.QueueEvent(progressEvt)
+func receiveHeader(conn net.Conn, t *Transfer) (relPath string, size int64, meta fileMetadata, err error) {
+	header, err := expectFrame(conn, frameHeader, "file header")
+	if err != nil {
+		return "", 0, meta, err
+	}
+	if len(header) < 16 {
+		return "", 0, meta, newTransferError(errTamperedChunk, "Received malformed file header.", nil)
+	}
+	meta.Mode = os.FileMode(binary.BigEndian.Uint64(header[0:])) & (os.ModeDir | os.ModePerm)
+	size = int64(binary.BigEndian.Uint64(header[8:]))
+	if size < 0 {
+		return "", 0, meta, newTransferError(errTamperedChunk, fmt.Sprintf("Received invalid file size %d.", size), nil)
+	}
+	rest := header[16:]
+	if t.hasCapability(capMetadata) {
+		if rest, err = decodeMetadata(rest, &meta); err != nil {
+			return "", 0, meta, err
+		}
+	}
+	if len(rest) > maxFilenameLen {
+		return "", 0, meta, newTransferError(errTamperedChunk, "Received malformed file header.", nil)
+	}
+	return string(rest), size, meta, nil
 }
 
-func showProgressBar(t *Transfer) {
-	progressEvt := wx.NewThreadEvent(wx.EVT_THREAD, progressBarShow)
-	t.Frame.QueueEvent(progressEvt)
+func sendCount(pConn *net.Conn, t *Transfer) error {
+	err := writeInt64Frame(*pConn, frameCount, int64(len(t.Entries)))
+	if err != nil {
+		return streamError("Error transmitting number of files:", err)
+	}
+	return err
 }
 
-func updateFilename(t *Transfer) {
-	filenameEvt := wx.NewThreadEvent(wx.EVT_THREAD, receiveFileUpdate)
-	filenameEvt.SetString(t.Filepath)
-	t.Frame.QueueEvent(filenameEvt)
+func receiveCount(pConn *net.Conn, t *Transfer) (int, error) {
+	numFiles, err := expectInt64Frame(*pConn, frameCount, "number of files")
+	if err != nil {
+		return 0, err
+	}
+	if numFiles < 0 {
+		return 0, newTransferError(errTamperedChunk, fmt.Sprintf("Received invalid number of files %d.", numFiles), nil)
+	}
+	return int(numFiles), nil
 }
 
 func ceil(x, y int64) int64 {
@@ -0,0 +1,432 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// exit codes for the command-line interface
+const (
+	exitOK           = 0
+	exitError        = 1
+	exitUsage        = 2
+	exitBadPassword  = 3
+	exitVerification = 4
+	exitConnection   = 5
+	exitLocalIO      = 6
+	exitIncompatible = 7
+	exitCanceled     = 130
+)
+
+const cliUsage = `Usage:
+  flyingcarpet send --peer <mac|windows|linux> [--password <password>] <file or folder>...
+  flyingcarpet receive --peer <mac|windows|linux> [--dir <folder>]
+  flyingcarpet send --link lan [--address <receiving end's IP>] [--password <password>] <file or folder>...
+  flyingcarpet receive --link <lan|loopback> [--dir <folder>]
+  flyingcarpet send --duplex [--dir <folder>] [options] [<file or folder>...]
+  flyingcarpet receive --duplex [--dir <folder>] [options] [<file or folder>...]
+  flyingcarpet settings [on-conflict <policy> | keep-partial <true|false> | xattrs <true|false>]
+
+Run with no arguments to start the graphical interface.
+
+--link chooses how the two computers reach each other:
+  adhoc     (default) set up an ad hoc WiFi network between them. Needs --peer.
+  lan       use a network both are already on: Ethernet, a USB network link, or a LAN.
+            The sending end finds the receiving end over mDNS. If that's blocked, pass one
+            of the addresses the receiving end prints to the sending end with --address.
+  loopback  both ends on this computer.
+
+The receiving end listens on TCP port 3290, or another free port if that one's taken, and
+prints which. Choose one with --port (0 for any free port). With adhoc and lan, the sending
+end learns the port along with the address; with --address or loopback, give the sending
+end the same --port.
+
+--streams N sends file contents over N connections at once, which can be faster on a quick
+link. It's set on the sending end; the receiving end follows. Between 1 (the default) and 16.
+
+Before anything is sent, the receiving end lists what's coming and asks which of it to
+accept: all of it, none, or a list of numbers. --yes accepts everything without asking.
+Either way, the receiving end refuses up front if it doesn't have room for what it accepted.
+
+--on-conflict says what to do when a file being received is already there:
+  rename          (default) keep both, saving the new one as "name (1).ext"
+  overwrite       replace the old one, but only once the new one has arrived complete
+  skip-identical  don't receive it if it has the same contents, otherwise rename
+  skip            don't receive it
+  ask             ask for each one
+"flyingcarpet settings on-conflict <policy>" changes the default, which the graphical
+interface shares. "flyingcarpet settings" shows the saved defaults.
+
+Files are received under a temporary name ending in .flyingcarpet.part and only get their
+real name once they're complete and verified. If a transfer fails, the partial file is kept
+so running it again resumes where it left off. --keep-partial=false deletes it instead, and
+"flyingcarpet settings keep-partial false" makes that the default.
+
+Received files keep the sending end's permissions and modification time, as far as the
+receiving end's filesystem can represent them. --xattrs also copies extended attributes: on
+Linux those in the user namespace, on a Mac all but the quarantine flag. Both ends need
+--xattrs. "flyingcarpet settings xattrs true" makes it the default.
+
+--duplex starts a two-way session: once connected, each end sends the files it was given
+and saves the other's in its --dir. Either end may have nothing to send. Both ends need
+--duplex; if only one has it, the session is one-way as usual. The end running "receive"
+still sets up the connection and prints the password.
+
+The receiving end prints a password. Start the receiving end first, then run the
+sending end and enter that password when prompted (or pass it with --password).
+Options must come before the list of files.
+
+Exit codes:
+  0    transfer complete
+  1    transfer failed
+  2    invalid arguments
+  3    wrong password
+  4    received data failed verification
+  5    lost connection to peer
+  6    could not read or write a local file
+  7    peer is running an incompatible version
+  130  canceled
+`
+
+func runCli(args []string) int {
+	var mode string
+	switch args[0] {
+	case "send":
+		mode = "sending"
+	case "receive":
+		mode = "receiving"
+	case "settings":
+		return runSettings(args[1:])
+	case "help", "-h", "-help", "--help":
+		fmt.Print(cliUsage)
+		return exitOK
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown command %q.\n\n%s", args[0], cliUsage)
+		return exitUsage
+	}
+
+	flags := flag.NewFlagSet(args[0], flag.ContinueOnError)
+	flags.Usage = func() { fmt.Fprint(os.Stderr, cliUsage) }
+	peer := flags.String("peer", "", "operating system of the other computer: mac, windows, or linux")
+	linkName := flags.String("link", "adhoc", "how to reach the other computer: "+strings.Join(linkNames, ", "))
+	address := flags.String("address", "", "receiving end's IP address, for --link lan if mDNS doesn't find it (sending only)")
+	password := flags.String("password", "", "password shown on the receiving end (sending only)")
+	dir := flags.String("dir", ".", "folder to save received files in (receiving or --duplex)")
+	port := flags.Int("port", defaultPort, "TCP port to listen on, or 0 for any free one (receiving); port to connect to with --address or --link loopback (sending)")
+	streams := flags.Int("streams", 1, "connections to send file contents over, 1 to 16 (sending only)")
+	duplex := flags.Bool("duplex", false, "send and receive in one session, if the other end also asks to")
+	saved := loadSettings()
+	onConflict := flags.String("on-conflict", string(saved.OnConflict), "what to do with files that are already there: "+conflictPolicyNames()+" (receiving or --duplex)")
+	keepPartial := flags.Bool("keep-partial", saved.KeepPartial, "if a file isn't received completely, keep what was so the transfer can resume (receiving or --duplex)")
+	xattrs := flags.Bool("xattrs", saved.Xattrs, "copy extended attributes too, if the other end also asks to")
+	yes := flags.Bool("yes", false, "accept everything the sending end offers without asking (receiving or --duplex)")
+	if err := flags.Parse(args[1:]); err != nil {
+		if err == flag.ErrHelp {
+			return exitOK
+		}
+		return exitUsage
+	}
+
+	link, err := newLink(*linkName)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error()+" Please choose one of: "+strings.Join(linkNames, ", ")+".")
+		return exitUsage
+	}
+	policy, err := parseConflictPolicy(*onConflict)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error()+" Please choose one of: "+conflictPolicyNames()+".")
+		return exitUsage
+	}
+	if *streams < 1 || *streams > maxStreams {
+		fmt.Fprintf(os.Stderr, "Please choose between 1 and %d streams.\n", maxStreams)
+		return exitUsage
+	}
+	*peer = strings.ToLower(*peer)
+	if *linkName == "adhoc" && *peer != "mac" && *peer != "windows" && *peer != "linux" {
+		fmt.Fprintln(os.Stderr, "Please specify the other computer's operating system with --peer mac, --peer windows, or --peer linux.")
+		return exitUsage
+	}
+
+	ctx, cancelCtx := context.WithCancel(context.Background())
+	t := &Transfer{
+		Mode:        mode,
+		Port:        *port,
+		Streams:     *streams,
+		Duplex:      *duplex,
+		AutoAccept:  *yes,
+		OnConflict:  policy,
+		KeepPartial: *keepPartial,
+		Xattrs:      *xattrs,
+		Peer:        *peer,
+		RecipientIP: *address,
+		Link:        link,
+		Ctx:         ctx,
+		CancelCtx:   cancelCtx,
+		UI:          &terminalUI{},
+	}
+
+	// make sure all files exist
+	for _, file := range flags.Args() {
+		if _, err := os.Stat(file); err != nil {
+			fmt.Fprintln(os.Stderr, "Could not find output file "+file)
+			fmt.Fprintln(os.Stderr, err.Error())
+			return exitUsage
+		}
+		t.FileList = append(t.FileList, file)
+	}
+	if mode == "sending" && !*duplex && flags.NArg() == 0 {
+		fmt.Fprintln(os.Stderr, "Please specify at least one file or folder to send.")
+		return exitUsage
+	}
+	if mode == "receiving" && !*duplex && flags.NArg() != 0 {
+		fmt.Fprintln(os.Stderr, "Receiving doesn't take a list of files. Use --dir to choose where to save them.")
+		return exitUsage
+	}
+
+	if mode == "receiving" || *duplex {
+		folder, err := filepath.Abs(*dir)
+		if err == nil {
+			var info os.FileInfo
+			if info, err = os.Stat(folder); err == nil && !info.IsDir() {
+				err = fmt.Errorf("%s is not a folder", folder)
+			}
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Please select valid folder: "+err.Error())
+			return exitUsage
+		}
+		t.Destination = folder + string(os.PathSeparator)
+		if mode == "receiving" {
+			t.Filepath = t.Destination
+		}
+	}
+	if mode == "sending" {
+		t.Passphrase = *password
+		if t.Passphrase == "" {
+			fmt.Print("Enter password from receiving end: ")
+			line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+			if err != nil && line == "" {
+				fmt.Fprintln(os.Stderr, "\nPassword entry was cancelled.")
+				return exitUsage
+			}
+			t.Passphrase = strings.TrimSpace(line)
+		}
+	}
+
+	// ctrl-c cancels the transfer but still lets mainRoutine put the wifi back
+	canceled := make(chan struct{})
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, os.Interrupt)
+	go func() {
+		<-sigChan
+		t.output("Canceling transfer...")
+		close(canceled)
+		t.CancelCtx()
+	}()
+
+	err = mainRoutine(t)
+	if err == nil {
+		return exitOK
+	}
+	select {
+	case <-canceled:
+		return exitCanceled
+	default:
+	}
+	switch {
+	case isErrorKind(err, errBadPassword):
+		return exitBadPassword
+	case isErrorKind(err, errTamperedChunk):
+		return exitVerification
+	case isErrorKind(err, errTruncatedStream):
+		return exitConnection
+	case isErrorKind(err, errLocalIO):
+		return exitLocalIO
+	case isErrorKind(err, errIncompatiblePeer):
+		return exitIncompatible
+	}
+	return exitError
+}
+
+// runSettings shows the saved defaults, or changes one.
+func runSettings(args []string) int {
+	s := loadSettings()
+	switch {
+	case len(args) == 0:
+		fmt.Printf("on-conflict   %s\n", s.OnConflict)
+		fmt.Printf("keep-partial  %t\n", s.KeepPartial)
+		fmt.Printf("xattrs        %t\n", s.Xattrs)
+		return exitOK
+	case len(args) == 2 && args[0] == "on-conflict":
+		policy, err := parseConflictPolicy(args[1])
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err.Error()+" Please choose one of: "+conflictPolicyNames()+".")
+			return exitUsage
+		}
+		s.OnConflict = policy
+	case len(args) == 2 && args[0] == "keep-partial":
+		keep, err := strconv.ParseBool(args[1])
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Please choose true or false for keep-partial.")
+			return exitUsage
+		}
+		s.KeepPartial = keep
+	case len(args) == 2 && args[0] == "xattrs":
+		copyXattrs, err := strconv.ParseBool(args[1])
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Please choose true or false for xattrs.")
+			return exitUsage
+		}
+		s.Xattrs = copyXattrs
+	default:
+		fmt.Fprint(os.Stderr, cliUsage)
+		return exitUsage
+	}
+	if err := saveSettings(s); err != nil {
+		fmt.Fprintln(os.Stderr, "Could not save settings: "+err.Error())
+		return exitError
+	}
+	return exitOK
+}
+
+// terminalUI prints to stdout. The progress line is redrawn in place, so anything else
+// printed while it's showing starts on a fresh line.
+type terminalUI struct {
+	lock            sync.Mutex
+	progressShowing bool
+	input           *bufio.Reader
+}
+
+func (u *terminalUI) Output(msg string) {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	if u.progressShowing {
+		fmt.Println()
+		u.progressShowing = false
+	}
+	fmt.Println(msg)
+}
+
+// the password is already in the output
+func (u *terminalUI) ShowPassword(password string) {}
+
+// ReviewFiles lists what's on offer and asks which to accept. If there's no answer, because
+// standard input isn't a terminal, everything is declined.
+func (u *terminalUI) ReviewFiles(entries []manifestEntry, totalSize int64) []bool {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	if u.progressShowing {
+		fmt.Println()
+		u.progressShowing = false
+	}
+	fmt.Printf("The sending end is offering %d, %s in all:\n", len(entries), makeSizeReadable(totalSize))
+	for i, e := range entries {
+		if e.Mode.IsDir() {
+			fmt.Printf("%5d  %s/\n", i+1, e.RelPath)
+		} else {
+			fmt.Printf("%5d  %s (%s)\n", i+1, e.RelPath, makeSizeReadable(e.Size))
+		}
+	}
+	for {
+		fmt.Print("Accept all [Y], none [n], or only the numbers listed (e.g. 1,3-5)? ")
+		line, err := u.stdin().ReadString('\n')
+		if err != nil && line == "" {
+			fmt.Println("\nNo answer, declining. Use --yes to accept without asking.")
+			return nil
+		}
+		accept, err := parseSelection(strings.TrimSpace(line), len(entries))
+		if err == nil {
+			return accept
+		}
+		fmt.Println(err)
+	}
+}
+
+// ResolveConflict asks what to do about one file that's already there. With no answer, it's skipped.
+func (u *terminalUI) ResolveConflict(path string) conflictPolicy {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	if u.progressShowing {
+		fmt.Println()
+		u.progressShowing = false
+	}
+	for {
+		fmt.Printf("%s is already here. Keep both [R], overwrite [o], or skip [s]? ", path)
+		line, err := u.stdin().ReadString('\n')
+		if err != nil && line == "" {
+			fmt.Println("\nNo answer, skipping.")
+			return conflictSkip
+		}
+		switch strings.ToLower(strings.TrimSpace(line)) {
+		case "", "r", "rename":
+			return conflictRename
+		case "o", "overwrite":
+			return conflictOverwrite
+		case "s", "skip":
+			return conflictSkip
+		}
+	}
+}
+
+func (u *terminalUI) stdin() *bufio.Reader {
+	if u.input == nil {
+		u.input = bufio.NewReader(os.Stdin)
+	}
+	return u.input
+}
+
+// parseSelection turns an answer to ReviewFiles's prompt into which of n entries to accept.
+func parseSelection(answer string, n int) ([]bool, error) {
+	accept := make([]bool, n)
+	switch strings.ToLower(answer) {
+	case "", "y", "yes", "a", "all":
+		for i := range accept {
+			accept[i] = true
+		}
+		return accept, nil
+	case "n", "no", "none":
+		return accept, nil
+	}
+	for _, field := range strings.Split(answer, ",") {
+		field = strings.TrimSpace(field)
+		first, last := field, field
+		if dash := strings.Index(field, "-"); dash > 0 {
+			first, last = field[:dash], field[dash+1:]
+		}
+		from, err1 := strconv.Atoi(strings.TrimSpace(first))
+		to, err2 := strconv.Atoi(strings.TrimSpace(last))
+		if err1 != nil || err2 != nil || from < 1 || to > n || from > to {
+			return nil, fmt.Errorf("%q isn't a number or range from 1 to %d.", field, n)
+		}
+		for i := from; i <= to; i++ {
+			accept[i-1] = true
+		}
+	}
+	return accept, nil
+}
+
+func (u *terminalUI) FileStarted(path string) {}
+
+func (u *terminalUI) Progress(percentage int) {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	const width = 40
+	filled := width * percentage / 100
+	fmt.Printf("\r[%s%s] %3d%%", strings.Repeat("=", filled), strings.Repeat(" ", width-filled), percentage)
+	u.progressShowing = percentage < 100
+	if !u.progressShowing {
+		fmt.Println()
+	}
+}
+
+func (u *terminalUI) FileFinished(path string) {}
+
+func (u *terminalUI) TransferFinished(err error) {}
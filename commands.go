@@ -0,0 +1,9 @@
+package main
+
+// commandRunner runs the shell commands the network setup code uses to drive the OS's WiFi
+// tools. Going through it instead of os/exec lets tests hand that code a scripted fake and
+// exercise it without a WiFi card.
+type commandRunner interface {
+	// Run runs cmd in a shell and returns its combined stdout and stderr.
+	Run(cmd string) (output string, err error)
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"time"
+)
+
+// scriptedRunner replays canned output for commands, in the order they're expected, and
+// remembers what was run and how long the caller slept so a test can check both.
+type scriptedRunner struct {
+	lock   sync.Mutex
+	script []scriptedCommand
+	ran    []string
+	slept  time.Duration
+}
+
+// scriptedCommand answers any command containing match. It's used up after times runs, or
+// never if times is 0, and then the next matching entry in the script answers instead.
+type scriptedCommand struct {
+	match  string
+	output string
+	err    error
+	times  int
+	used   int
+}
+
+func (r *scriptedRunner) Run(cmd string) (string, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.ran = append(r.ran, cmd)
+	for i := range r.script {
+		sc := &r.script[i]
+		if !strings.Contains(cmd, sc.match) || (sc.times > 0 && sc.used >= sc.times) {
+			continue
+		}
+		sc.used++
+		return sc.output, sc.err
+	}
+	return "", errors.New("unexpected command: " + cmd)
+}
+
+func (r *scriptedRunner) sleep(d time.Duration) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.slept += d
+}
+
+// count is how many commands containing s were run.
+func (r *scriptedRunner) count(s string) (n int) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	for _, cmd := range r.ran {
+		if strings.Contains(cmd, s) {
+			n++
+		}
+	}
+	return
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+	"github.com/klauspost/compress/zstd"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Compression. When both ends support it, the sending end compresses each chunk with zstd
+// before encrypting it, unless the file is a kind that's already compressed, and sends the
+// chunk as is if compressing didn't make it smaller. The first byte of each chunk's
+// plaintext says which it is, so the marking is covered by the encryption like everything
+// else. Compressing first matters: encrypted data doesn't compress.
+
+// how a chunk's data is encoded, the first byte of its plaintext
+const (
+	chunkRaw byte = iota
+	chunkZstd
+)
+
+// chunkHeadroom is the room the pipeline leaves in front of a chunk's data for its index and
+// encoding, so a chunk sent as is needn't be copied to add them.
+const chunkHeadroom = chunkIndexSize + 1
+
+// extensions of files that are already compressed, so compressing them again is wasted time
+var compressedExtensions = map[string]bool{
+	".7z": true, ".aac": true, ".apk": true, ".avi": true, ".br": true, ".bz2": true, ".dmg": true,
+	".docx": true, ".epub": true, ".flac": true, ".gif": true, ".gz": true, ".heic": true, ".jar": true,
+	".jpeg": true, ".jpg": true, ".lz4": true, ".m4a": true, ".m4v": true, ".mkv": true, ".mov": true,
+	".mp3": true, ".mp4": true, ".ogg": true, ".opus": true, ".png": true, ".pptx": true, ".rar": true,
+	".tgz": true, ".webm": true, ".webp": true, ".xlsx": true, ".xz": true, ".zip": true, ".zst": true,
+}
+
+// worthCompressing says whether the sending end should try compressing the file at path.
+func worthCompressing(t *Transfer, path string) bool {
+	return t.hasCapability(capCompression) && !compressedExtensions[strings.ToLower(filepath.Ext(path))]
+}
+
+// The encoder and decoder are safe for concurrent use and keep their own pools of state, so
+// one of each serves every chunk. They're made the first time they're needed.
+var (
+	zstdOnce    sync.Once
+	zstdEncoder *zstd.Encoder
+	zstdDecoder *zstd.Decoder
+)
+
+func initZstd() {
+	zstdOnce.Do(func() {
+		var err error
+		if zstdEncoder, err = zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.SpeedDefault)); err != nil {
+			panic(err)
+		}
+		// DecodeAll stops at the capacity of the buffer it's given, so a chunk can't
+		// decompress to more than a chunk's worth of memory
+		if zstdDecoder, err = zstd.NewReader(nil, zstd.WithDecoderConcurrency(0), zstd.WithDecodeAllCapLimit(true)); err != nil {
+			panic(err)
+		}
+	})
+}
+
+// compressChunk appends the zstd-compressed data to dst, or returns false if that wouldn't
+// be smaller than data.
+func compressChunk(dst, data []byte) ([]byte, bool) {
+	initZstd()
+	compressed := zstdEncoder.EncodeAll(data, dst)
+	return compressed, len(compressed)-len(dst) < len(data)
+}
+
+// decompressChunk decompresses data into dst[:0], which must have room for a whole chunk.
+func decompressChunk(dst, data []byte) ([]byte, error) {
+	initZstd()
+	decompressed, err := zstdDecoder.DecodeAll(data, dst[:0])
+	if err != nil || len(decompressed) > CHUNKSIZE {
+		return nil, newTransferError(errTamperedChunk, "Received chunk could not be decompressed.", err)
+	}
+	return decompressed, nil
+}
+
+// fileProgress is how far along a file is, updated by the pipeline as chunks go by.
+type fileProgress struct {
+	bytesLeft int64 // of the file's data
+	wireBytes int64 // of chunk frames, after compression and encryption
+}
+
+func (p *fileProgress) left() int64 {
+	return atomic.LoadInt64(&p.bytesLeft)
+}
+
+// chunkDone counts a chunk of size bytes of file data that took wire bytes to send.
+func (p *fileProgress) chunkDone(size, wire int64) {
+	atomic.AddInt64(&p.bytesLeft, -size)
+	atomic.AddInt64(&p.wireBytes, wire)
+}
+
+// reportSpeed tells the user how fast data bytes of the file went, and with compression, how
+// much smaller they were on the wire.
+func reportSpeed(t *Transfer, data int64, p *fileProgress, elapsed time.Duration) {
+	seconds := elapsed.Seconds()
+	t.output(fmt.Sprintf("Speed: %.2fmbps", float64(data*8)/1000000/seconds))
+	wire := atomic.LoadInt64(&p.wireBytes)
+	if t.hasCapability(capCompression) && data > 0 && wire > 0 {
+		t.output(fmt.Sprintf("Compression: %s of data in %s on the wire (%.2fx), %.2fmbps on the wire",
+			makeSizeReadable(data), makeSizeReadable(wire), float64(data)/float64(wire), float64(wire*8)/1000000/seconds))
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// What to do when a file being received is already in the destination folder.
+type conflictPolicy string
+
+const (
+	conflictRename        conflictPolicy = "rename"         // keep both, numbering the new one
+	conflictOverwrite     conflictPolicy = "overwrite"      // replace the old one once the new one is complete
+	conflictSkipIdentical conflictPolicy = "skip-identical" // skip it if the contents match, otherwise rename
+	conflictSkip          conflictPolicy = "skip"           // keep the old one and don't receive the new one
+	conflictAsk           conflictPolicy = "ask"            // ask the user for each file
+)
+
+var conflictPolicies = []conflictPolicy{conflictRename, conflictOverwrite, conflictSkipIdentical, conflictSkip, conflictAsk}
+
+func parseConflictPolicy(s string) (conflictPolicy, error) {
+	for _, p := range conflictPolicies {
+		if string(p) == strings.ToLower(s) {
+			return p, nil
+		}
+	}
+	return "", errors.New("Unknown conflict policy " + s + ".")
+}
+
+func conflictPolicyNames() string {
+	var names []string
+	for _, p := range conflictPolicies {
+		names = append(names, string(p))
+	}
+	return strings.Join(names, ", ")
+}
+
+// inTheWay reports whether there's already something at path.
+func inTheWay(path string) bool {
+	_, err := os.Lstat(path)
+	return err == nil
+}
+
+// placeFile decides where a file that belongs at outPath is saved, and whether that replaces
+// a file that's already there.
+func placeFile(outPath string, policy conflictPolicy) (final string, replacing bool) {
+	if !inTheWay(outPath) {
+		return outPath, false
+	}
+	if policy == conflictOverwrite {
+		return outPath, true
+	}
+	for n := 1; ; n++ {
+		candidate := numberedPath(outPath, n)
+		if !inTheWay(candidate) {
+			return candidate, false
+		}
+	}
+}
+
+// numberedPath turns dir/name.ext into dir/name (n).ext.
+func numberedPath(path string, n int) string {
+	ext := filepath.Ext(path)
+	return fmt.Sprintf("%s (%d)%s", strings.TrimSuffix(path, ext), n, ext)
+}
+
+// resolveConflicts applies t.OnConflict to the accepted entries that are already in the
+// destination folder, before anything is sent. Entries to be skipped are declined, and the
+// rest are marked with whether to rename or overwrite. If skipping identical files, the
+// sending end is asked for the hashes of the ones that are the same size as what's here.
+func resolveConflicts(t *Transfer, entries []manifestEntry, accept []bool) (needHashes []bool, err error) {
+	needHashes = make([]bool, len(entries))
+	for i := range entries {
+		m := &entries[i]
+		if !accept[i] || m.Mode.IsDir() {
+			continue
+		}
+		outPath, err := safeJoin(t.Destination, m.RelPath)
+		if err != nil {
+			return nil, err
+		}
+		if !inTheWay(outPath) {
+			continue
+		}
+		policy := t.OnConflict
+		if policy == conflictAsk {
+			answered := make(chan conflictPolicy, 1)
+			go func() { answered <- t.UI.ResolveConflict(outPath) }()
+			select {
+			case policy = <-answered:
+			case <-t.Ctx.Done():
+				return nil, errors.New("Exiting resolveConflicts, transfer was canceled.")
+			}
+		}
+		switch policy {
+		case conflictSkip:
+			t.output("Skipping " + m.RelPath + ", which is already here.")
+			accept[i] = false
+		case conflictSkipIdentical:
+			m.onConflict = conflictRename
+			if info, err := os.Stat(outPath); err == nil && info.Size() == m.Size {
+				needHashes[i] = true
+			}
+		case conflictOverwrite:
+			m.onConflict = conflictOverwrite
+		default:
+			m.onConflict = conflictRename
+		}
+	}
+	return needHashes, nil
+}
+
+// skipIdentical declines the entries whose hash from the sending end matches the file already here.
+func skipIdentical(t *Transfer, entries []manifestEntry, accept []bool) {
+	for i, m := range entries {
+		if m.Hash == nil || !accept[i] {
+			continue
+		}
+		outPath, err := safeJoin(t.Destination, m.RelPath)
+		if err != nil {
+			continue
+		}
+		if hash, err := hashFile(outPath); err == nil && bytes.Equal(hash, m.Hash) {
+			t.output("Skipping " + m.RelPath + ", which is already here with the same contents.")
+			accept[i] = false
+		}
+	}
+}
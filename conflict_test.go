@@ -0,0 +1,150 @@
+package main
+
+import (
+	"crypto/sha256"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+)
+
+func TestNameCollision(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src", "same.txt")
+	data, err := writeRandomFile(src, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dest := filepath.Join(dir, "dest")
+	existing, err := writeRandomFile(filepath.Join(dest, "same.txt"), 500)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = writeRandomFile(filepath.Join(dest, "same (1).txt"), 700); err != nil {
+		t.Fatal(err)
+	}
+	if err = checkBothSucceeded(newTestPair([]string{src}, dest).run()); err != nil {
+		t.Fatal(err)
+	}
+	if err = checkFile(filepath.Join(dest, "same.txt"), existing); err != nil {
+		t.Fatalf("existing file was changed: %s", err)
+	}
+	if err = checkFile(filepath.Join(dest, "same (2).txt"), data); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestConflictPolicies(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src")
+	sent := map[string][]byte{}
+	for _, name := range []string{"identical.bin", "different.bin", "new.bin"} {
+		data, err := writeRandomFile(filepath.Join(src, name), CHUNKSIZE+10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sent[name] = data
+	}
+	files := []string{filepath.Join(src, "identical.bin"), filepath.Join(src, "different.bin"), filepath.Join(src, "new.bin")}
+
+	for _, policy := range []conflictPolicy{conflictOverwrite, conflictSkipIdentical, conflictSkip, conflictAsk} {
+		dest := filepath.Join(dir, string(policy))
+		if err := os.Mkdir(dest, 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(dest, "identical.bin"), sent["identical.bin"], 0644); err != nil {
+			t.Fatal(err)
+		}
+		old, err := writeRandomFile(filepath.Join(dest, "different.bin"), CHUNKSIZE+10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		p := newTestPair(files, dest)
+		p.receiver.OnConflict = policy
+		// asked, overwrite one and skip the other
+		p.receiverUI.resolve = func(path string) conflictPolicy {
+			if filepath.Base(path) == "different.bin" {
+				return conflictOverwrite
+			}
+			return conflictSkip
+		}
+		var chunks int32
+		p.wrapSender = func(conn net.Conn) net.Conn {
+			return &chunkHook{Conn: conn, hook: func(conn net.Conn, n int, payload []byte) (int, error) {
+				atomic.AddInt32(&chunks, 1)
+				return conn.Write(payload)
+			}}
+		}
+		if err = checkBothSucceeded(p.run()); err != nil {
+			t.Fatalf("%s: %s", policy, err)
+		}
+
+		want := map[string][]byte{"identical.bin": sent["identical.bin"], "new.bin": sent["new.bin"]}
+		var wantChunks int32
+		switch policy {
+		case conflictOverwrite:
+			want["different.bin"] = sent["different.bin"]
+			wantChunks = 6
+		case conflictAsk:
+			want["different.bin"] = sent["different.bin"]
+			wantChunks = 4
+		case conflictSkipIdentical:
+			want["different.bin"] = old
+			want["different (1).bin"] = sent["different.bin"]
+			wantChunks = 4
+		case conflictSkip:
+			want["different.bin"] = old
+			wantChunks = 2
+		}
+		for name, data := range want {
+			if err = checkFile(filepath.Join(dest, name), data); err != nil {
+				t.Fatalf("%s: %s", policy, err)
+			}
+		}
+		if chunks != wantChunks {
+			t.Fatalf("%s: %d chunks sent, expected %d", policy, chunks, wantChunks)
+		}
+		leftovers, _ := filepath.Glob(filepath.Join(dest, "*"+partSuffix))
+		if len(leftovers) > 0 {
+			t.Fatalf("%s: left %s behind", policy, leftovers[0])
+		}
+	}
+}
+
+func TestHashesSealed(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src", "same.bin")
+	data, err := writeRandomFile(src, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dest := filepath.Join(dir, "dest")
+	if err = os.Mkdir(dest, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(filepath.Join(dest, "same.bin"), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	p := newTestPair([]string{src}, dest)
+	p.receiver.OnConflict = conflictSkipIdentical
+	var recorders []*wireRecorder
+	p.wrapSender = func(conn net.Conn) net.Conn {
+		r := &wireRecorder{Conn: conn}
+		recorders = append(recorders, r)
+		return r
+	}
+	if err = checkBothSucceeded(p.run()); err != nil {
+		t.Fatal(err)
+	}
+	if !p.receiverUI.contains("Skipping same.bin") {
+		t.Fatal("the identical file wasn't skipped")
+	}
+	hash := sha256.Sum256(data)
+	for _, r := range recorders {
+		if r.contains(hash[:]) {
+			t.Fatal("the file's hash was sent in the clear")
+		}
+	}
+}
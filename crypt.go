@@ -2,14 +2,42 @@ package main
 
 import (
 	"crypto/rand"
+	"golang.org/x/crypto/argon2"
 	"golang.org/x/crypto/nacl/secretbox"
 	"io"
 )
 
-func encrypt(chunk []byte, passphrase string) (encrypted []byte) {
+const saltSize = 16
 
+// argon2id parameters. Key derivation runs once per transfer, so these can be
+// expensive enough to make guessing the short transfer password costly.
+const kdfTime = 3
+const kdfMemory = 64 * 1024 // KiB
+const kdfThreads = 4
+
+// deriveKey stretches the transfer password with the per-transfer salt sent by the
+// sending end. The result feeds the key exchange in pake.go.
+func deriveKey(passphrase string, salt []byte) *[32]byte {
 	var key [32]byte
-	copy(key[:], passphrase)
+	copy(key[:], argon2.IDKey([]byte(passphrase), salt, kdfTime, kdfMemory, kdfThreads, uint32(len(key))))
+	return &key
+}
+
+func generateSalt() []byte {
+	salt := make([]byte, saltSize)
+	_, err := io.ReadFull(rand.Reader, salt)
+	if err != nil {
+		panic(err)
+	}
+	return salt
+}
+
+func encrypt(chunk []byte, key *[32]byte) (encrypted []byte) {
+	return encryptTo(nil, chunk, key)
+}
+
+// encryptTo is encrypt, appending to dst[:0] so a buffer can be reused.
+func encryptTo(dst, chunk []byte, key *[32]byte) (encrypted []byte) {
 
 	var nonce [24]byte
 	_, err := io.ReadFull(rand.Reader, nonce[:])
@@ -17,21 +45,26 @@ func encrypt(chunk []byte, passphrase string) (encrypted []byte) {
 		panic(err)
 	}
 
-	encrypted = secretbox.Seal(nonce[:], chunk, &nonce, &key)
+	encrypted = secretbox.Seal(append(dst[:0], nonce[:]...), chunk, &nonce, key)
 	return
 }
 
-func decrypt(chunk []byte, passphrase string) (decrypted []byte) {
+func decrypt(chunk []byte, key *[32]byte) (decrypted []byte, err error) {
+	return decryptTo(nil, chunk, key)
+}
 
-	var key [32]byte
-	copy(key[:], passphrase)
+// decryptTo is decrypt, appending to dst[:0] so a buffer can be reused. dst can't overlap chunk.
+func decryptTo(dst, chunk []byte, key *[32]byte) (decrypted []byte, err error) {
 
+	if len(chunk) < 24+secretbox.Overhead {
+		return nil, newTransferError(errTamperedChunk, "Received chunk is too short to be valid.", nil)
+	}
 	var decryptNonce [24]byte
 	copy(decryptNonce[:], chunk[:24])
 
-	decrypted, ok := secretbox.Open(nil, chunk[24:], &decryptNonce, &key)
+	decrypted, ok := secretbox.Open(dst[:0], chunk[24:], &decryptNonce, key)
 	if !ok {
-		panic("error decrypting")
+		return nil, newTransferError(errTamperedChunk, "Received chunk failed authentication. Data was corrupted or tampered with in transit.", nil)
 	}
 	return
 }
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/argon2"
+	"net"
+	"strconv"
+	"time"
+)
+
+// Peer discovery on the ad hoc network. While the receiving end waits for a connection, it
+// broadcasts a beacon once a second on each of its networks saying which address and port
+// it's listening on, and the sending end dials the first beacon for this transfer it hears.
+// That works whatever subnet the network's host hands out.
+//
+// Beacons are tagged with a key stretched from the password, salted with the SSID, so beacons
+// from other transfers are ignored and nobody without the password can send the sending end
+// somewhere else. The stretching is the same argon2id as the key exchange's, so a captured
+// beacon is as costly to guess the password from as the password was made to be.
+
+const discoveryPort = 3291
+const discoveryTimeout = 60
+const beaconMagic = "FLYD"
+const beaconVersion = 3
+
+// magic, version, IPv4 address, port, tag
+const beaconSize = 4 + 1 + 4 + 2 + sha256.Size
+
+// beaconTarget is one network to announce on: this end's address there, and where to send
+// the beacon so everyone on it hears.
+type beaconTarget struct {
+	address   net.IP
+	broadcast net.IP
+}
+
+// broadcastTargets lists the networks this computer is on that beacons can be broadcast on.
+func broadcastTargets() (targets []beaconTarget) {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil
+	}
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagBroadcast == 0 || iface.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, a := range addrs {
+			ipNet, ok := a.(*net.IPNet)
+			if !ok || ipNet.IP.To4() == nil || len(ipNet.Mask) != net.IPv4len {
+				continue
+			}
+			ip := ipNet.IP.To4()
+			broadcast := make(net.IP, net.IPv4len)
+			for i := range ip {
+				broadcast[i] = ip[i] | ^ipNet.Mask[i]
+			}
+			targets = append(targets, beaconTarget{ip, broadcast})
+		}
+	}
+	return
+}
+
+// discoveryKey is the key beacons for this transfer are tagged with.
+func discoveryKey(t *Transfer) []byte {
+	return argon2.IDKey([]byte(t.Passphrase), []byte("FlyingCarpet-discovery\x00"+t.SSID), kdfTime, kdfMemory, kdfThreads, sha256.Size)
+}
+
+func encodeBeacon(key []byte, ip net.IP, port int) []byte {
+	b := make([]byte, 0, beaconSize)
+	b = append(b, beaconMagic...)
+	b = append(b, beaconVersion)
+	b = append(b, ip.To4()...)
+	b = append(b, byte(port>>8), byte(port))
+	mac := hmac.New(sha256.New, key)
+	mac.Write(b)
+	return mac.Sum(b)
+}
+
+// decodeBeacon returns the address and port in b, if it's a beacon tagged with key.
+func decodeBeacon(key []byte, b []byte) (ip net.IP, port int, ok bool) {
+	if len(b) != beaconSize || !bytes.HasPrefix(b, []byte(beaconMagic)) || b[4] != beaconVersion {
+		return nil, 0, false
+	}
+	body, tag := b[:beaconSize-sha256.Size], b[beaconSize-sha256.Size:]
+	mac := hmac.New(sha256.New, key)
+	mac.Write(body)
+	if !hmac.Equal(tag, mac.Sum(nil)) {
+		return nil, 0, false
+	}
+	return net.IP(body[5:9]), int(binary.BigEndian.Uint16(body[9:11])), true
+}
+
+// announce broadcasts beacons for t on the networks targets lists until the returned
+// function is called.
+func announce(t *Transfer, targets func() []beaconTarget) (stop func()) {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{})
+	if err != nil {
+		t.output("Could not announce this computer to the sending end: " + err.Error())
+		return func() {}
+	}
+	key := discoveryKey(t)
+	done := make(chan struct{})
+	go func() {
+		defer conn.Close()
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+		for {
+			// interfaces come and go while the link settles, so look each time
+			for _, target := range targets() {
+				conn.WriteToUDP(encodeBeacon(key, target.address, t.Port), &net.UDPAddr{IP: target.broadcast, Port: discoveryPort})
+			}
+			select {
+			case <-done:
+				return
+			case <-t.Ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+	return func() { close(done) }
+}
+
+// discoverPeer waits for a beacon from the receiving end, sets t.Port from it, and returns
+// the receiving end's address.
+func discoverPeer(t *Transfer) (string, error) {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{Port: discoveryPort})
+	if err != nil {
+		return "", fmt.Errorf("Could not listen for the receiving end on :%d. Err: %s", discoveryPort, err)
+	}
+	defer conn.Close()
+	key := discoveryKey(t)
+	t.output("Looking for peer IP for " + strconv.Itoa(discoveryTimeout) + " seconds.")
+	deadline := time.Now().Add(discoveryTimeout * time.Second)
+	buf := make([]byte, 512)
+	for time.Now().Before(deadline) {
+		select {
+		case <-t.Ctx.Done():
+			return "", errors.New("Exiting discoverPeer, transfer was canceled.")
+		default:
+		}
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		n, _, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			continue
+		}
+		if ip, port, ok := decodeBeacon(key, buf[:n]); ok {
+			t.Port = port
+			t.output(fmt.Sprintf("Peer IP found: %s", ip))
+			return ip.String(), nil
+		}
+	}
+	return "", errors.New("Could not find the peer computer within " + strconv.Itoa(discoveryTimeout) + " seconds. Make sure you entered the password shown on the receiving end.")
+}
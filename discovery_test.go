@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestDiscovery(t *testing.T) {
+	newEnd := func(mode, ssid string, port int) *Transfer {
+		end := &Transfer{Mode: mode, Passphrase: "abcd", SSID: ssid, Port: port, UI: &recordingUI{}}
+		end.Ctx, end.CancelCtx = context.WithCancel(context.Background())
+		return end
+	}
+	sender := newEnd("sending", "flyingCarpet_selftest", 0)
+	receiver := newEnd("receiving", "flyingCarpet_selftest", 45678)
+	defer receiver.CancelCtx()
+
+	type found struct {
+		ip  string
+		err error
+	}
+	result := make(chan found, 1)
+	go func() {
+		ip, err := discoverPeer(sender)
+		result <- found{ip, err}
+	}()
+	time.Sleep(200 * time.Millisecond)
+
+	// a stranger's transfer on the same network, a forgery by someone who can see the SSID but
+	// doesn't know the password, and a beacon for this transfer that's been tampered with
+	conn, err := net.DialUDP("udp4", nil, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: discoveryPort})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write(encodeBeacon(discoveryKey(newEnd("receiving", "flyingCarpet_000000", 0)), net.IPv4(127, 0, 0, 1), 1111))
+	forger := newEnd("receiving", "flyingCarpet_selftest", 0)
+	forger.Passphrase = "dcba"
+	conn.Write(encodeBeacon(discoveryKey(forger), net.IPv4(127, 0, 0, 1), 2222))
+	tampered := encodeBeacon(discoveryKey(receiver), net.IPv4(127, 0, 0, 1), 45678)
+	tampered[10] ^= 1
+	conn.Write(tampered)
+	time.Sleep(200 * time.Millisecond)
+
+	link := adHocLink{beaconTargets: func() []beaconTarget {
+		return []beaconTarget{{net.IPv4(127, 0, 0, 1), net.IPv4(127, 0, 0, 1)}}
+	}}
+	stop := link.Announce(receiver)
+	defer stop()
+	r := <-result
+	if r.err != nil {
+		t.Fatal(r.err)
+	}
+	if r.ip != "127.0.0.1" || sender.Port != 45678 {
+		t.Fatalf("expected to find 127.0.0.1:45678, found %s:%d", r.ip, sender.Port)
+	}
+}
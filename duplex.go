@@ -0,0 +1,67 @@
+package main
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// Two-way sessions. When both ends ask for one, the link, password, and key exchange happen
+// once as usual, and then each end sends its own files and receives the other's at the same
+// time, over the one connection. Each direction is an ordinary one-way session on its own
+// mux channel: channel 0 carries the dialing end's files and channel 1 the listening end's.
+// Either end can have nothing to send. The session is over once both directions are.
+
+const (
+	dialerChannel = iota
+	listenerChannel
+	duplexChannels
+)
+
+// exchangeFiles runs both directions of a two-way session over conn, sending t.FileList and
+// saving what the peer sends under t.Destination.
+func exchangeFiles(conn *net.Conn, t *Transfer) error {
+	session := newMuxSession(*conn, duplexChannels)
+	defer session.close()
+	dialer := t.Mode == "sending"
+	channel := func(id int) net.Conn {
+		return newSealedConn(session.channels[id], t.Key, sealDuplex+byte(id), dialer)
+	}
+	out, in := channel(dialerChannel), channel(listenerChannel)
+	if !dialer {
+		out, in = in, out
+	}
+	t.output("Two-way session started.")
+
+	var once sync.Once
+	var firstErr error
+	var wg sync.WaitGroup
+	run := func(direction *Transfer, channel net.Conn, transfer func(*net.Conn, *Transfer) error) {
+		defer wg.Done()
+		if err := transfer(&channel, direction); err != nil {
+			once.Do(func() {
+				firstErr = err
+				// stop the other direction too, wherever it's waiting
+				session.close()
+				(*conn).SetDeadline(time.Now())
+			})
+		}
+	}
+	wg.Add(2)
+	go run(t.direction("sending"), out, sendEntries)
+	go run(t.direction("receiving"), in, receiveEntries)
+	wg.Wait()
+	return firstErr
+}
+
+// direction is a copy of t for one direction of a two-way session. The data streams are
+// left out: everything goes over the session's one connection.
+func (t *Transfer) direction(mode string) *Transfer {
+	d := *t
+	d.Mode = mode
+	d.Entries = nil
+	d.StreamConns = nil
+	d.DialStream, d.AcceptStream = nil, nil
+	d.warned = nil
+	return &d
+}
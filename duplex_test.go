@@ -0,0 +1,64 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDuplex(t *testing.T) {
+	dir := t.TempDir()
+	sent := map[string][]byte{}
+	for name, size := range map[string]int{"a/to-listener.bin": 3*CHUNKSIZE + 5, "b/to-dialer.bin": 2*CHUNKSIZE + 9, "b/folder/note.txt": 10} {
+		data, err := writeRandomFile(filepath.Join(dir, filepath.FromSlash(name)), size)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sent[name] = data
+	}
+	p := newTestPair([]string{filepath.Join(dir, "a", "to-listener.bin")}, filepath.Join(dir, "b"))
+	p.sender.Duplex, p.receiver.Duplex = true, true
+	p.sender.Destination = filepath.Join(dir, "a")
+	p.receiver.FileList = []string{filepath.Join(dir, "b", "to-dialer.bin"), filepath.Join(dir, "b", "folder")}
+	if err := checkBothSucceeded(p.run()); err != nil {
+		t.Fatal(err)
+	}
+	if !p.senderUI.contains("Two-way session") || !p.receiverUI.contains("Two-way session") {
+		t.Fatal("ends didn't agree on a two-way session")
+	}
+	received := map[string]string{
+		"a/to-listener.bin": "b/to-listener.bin",
+		"b/to-dialer.bin":   "a/to-dialer.bin",
+		"b/folder/note.txt": "a/folder/note.txt",
+	}
+	for from, to := range received {
+		if err := checkFile(filepath.Join(dir, filepath.FromSlash(to)), sent[from]); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestDuplexOneWay(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src", "file.bin")
+	data, err := writeRandomFile(src, CHUNKSIZE+1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dest := filepath.Join(dir, "dest")
+	if err = os.Mkdir(dest, 0755); err != nil {
+		t.Fatal(err)
+	}
+	p := newTestPair([]string{src}, dest)
+	p.sender.Duplex = true
+	p.sender.Destination = filepath.Join(dir, "src")
+	if err = checkBothSucceeded(p.run()); err != nil {
+		t.Fatal(err)
+	}
+	if !p.senderUI.contains("files will only be sent") {
+		t.Fatal("sending end didn't say the session was one-way")
+	}
+	if err = checkFile(filepath.Join(dest, "file.bin"), data); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"errors"
+	"io"
+)
+
+type errorKind int
+
+const (
+	errBadPassword errorKind = iota
+	errTamperedChunk
+	errTruncatedStream
+	errLocalIO
+	errIncompatiblePeer
+)
+
+// transferError is returned from the chunker pipeline so callers can tell what went wrong
+// without string matching, and so nothing in the pipeline needs to panic.
+type transferError struct {
+	Kind errorKind
+	Msg  string
+	Err  error
+}
+
+func (e *transferError) Error() string {
+	if e.Err != nil {
+		return e.Msg + " " + e.Err.Error()
+	}
+	return e.Msg
+}
+
+func (e *transferError) Unwrap() error {
+	return e.Err
+}
+
+func newTransferError(kind errorKind, msg string, err error) error {
+	return &transferError{Kind: kind, Msg: msg, Err: err}
+}
+
+// streamError classifies a failed read from the peer: running out of data partway
+// through a message means the stream was cut off.
+func streamError(msg string, err error) error {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return newTransferError(errTruncatedStream, msg+" Connection closed before transfer finished.", err)
+	}
+	return newTransferError(errTruncatedStream, msg, err)
+}
+
+func isErrorKind(err error, kind errorKind) bool {
+	var te *transferError
+	return errors.As(err, &te) && te.Kind == kind
+}
@@ -1,7 +1,11 @@
+//go:build !nogui
+// +build !nogui
+
 package main
 
 import (
 	"context"
+	"fmt"
 	"github.com/dontpanic92/wxGo/wx"
 	"os"
 	"os/user"
@@ -18,15 +22,22 @@ const startButtonEnable = wx.ID_HIGHEST + 4
 const hideOptionID = wx.ID_HIGHEST + 5
 const receiveFileUpdate = wx.ID_HIGHEST + 6
 const popUpPassword = wx.ID_HIGHEST + 7
+const reviewFiles = wx.ID_HIGHEST + 8
+const resolveConflict = wx.ID_HIGHEST + 9
 
 type mainFrame struct {
 	wx.Frame
 	MenuBar wx.MenuBar
 	Panel   wx.Panel
+	// what the dialog picking which offered files to accept lists, and which were picked
+	reviewChoices []string
+	reviewAnswers chan []bool
+	// answers from the dialog asking what to do with a file that's already there
+	conflictAnswers chan conflictPolicy
 }
 
 func newGui() *mainFrame {
-	mf := &mainFrame{}
+	mf := &mainFrame{reviewAnswers: make(chan []bool), conflictAnswers: make(chan conflictPolicy)}
 	mf.Frame = wx.NewFrame(wx.NullWindow, wx.ID_ANY, "Flying Carpet")
 
 	if runtime.GOOS == "windows" {
@@ -36,6 +47,7 @@ func newGui() *mainFrame {
 
 	var t Transfer
 	var fileList []string
+	var duplexFileList []string
 
 	// window
 	mf.SetSize(400, 600)
@@ -59,17 +71,53 @@ func newGui() *mainFrame {
 	// bottom half
 	bSizerBottom := wx.NewBoxSizer(wx.VERTICAL)
 
+	// what to do with received files that are already there, remembered between runs
+	conflictChoices := []string{"Keep both", "Overwrite", "Skip if identical", "Skip", "Ask"}
+	conflictBox := wx.NewRadioBox(mf.Panel, wx.ID_ANY, "If a received file already exists", wx.DefaultPosition, wx.DefaultSize, conflictChoices, 3, wx.HORIZONTAL)
+	for i, p := range conflictPolicies {
+		if p == loadSettings().OnConflict {
+			conflictBox.SetSelection(i)
+		}
+	}
+	conflictBox.Hide()
+	bSizerBottom.Add(conflictBox, 0, wx.ALL|wx.EXPAND, 5)
+	keepPartialBox := wx.NewCheckBox(mf.Panel, wx.ID_ANY, "Keep partly received files to resume from", wx.DefaultPosition, wx.DefaultSize, 0)
+	keepPartialBox.SetValue(loadSettings().KeepPartial)
+	keepPartialBox.Hide()
+	bSizerBottom.Add(keepPartialBox, 0, wx.ALL|wx.EXPAND, 5)
+	xattrsBox := wx.NewCheckBox(mf.Panel, wx.ID_ANY, "Copy extended attributes (both ends need this on)", wx.DefaultPosition, wx.DefaultSize, 0)
+	xattrsBox.SetValue(loadSettings().Xattrs)
+	bSizerBottom.Add(xattrsBox, 0, wx.ALL|wx.EXPAND, 5)
+	duplexBox := wx.NewCheckBox(mf.Panel, wx.ID_ANY, "Two-way: both ends send and receive (both ends need this on)", wx.DefaultPosition, wx.DefaultSize, 0)
+	bSizerBottom.Add(duplexBox, 0, wx.ALL|wx.EXPAND, 5)
+
 	// file selection box
 	fileSizer := wx.NewBoxSizer(wx.HORIZONTAL)
 	sendButton := wx.NewButton(mf.Panel, wx.ID_ANY, "Select File(s)", wx.DefaultPosition, wx.DefaultSize, 0)
+	sendFolderButton := wx.NewButton(mf.Panel, wx.ID_ANY, "Select Folder", wx.DefaultPosition, wx.DefaultSize, 0)
 	receiveButton := wx.NewButton(mf.Panel, wx.ID_ANY, "Select Folder", wx.DefaultPosition, wx.DefaultSize, 0)
 	receiveButton.Hide()
 	fileBox := wx.NewTextCtrl(mf.Panel, wx.ID_ANY, "", wx.DefaultPosition, wx.DefaultSize, 0)
 	fileSizer.Add(sendButton, 0, wx.ALL|wx.EXPAND, 5)
+	fileSizer.Add(sendFolderButton, 0, wx.ALL|wx.EXPAND, 5)
 	fileSizer.Add(receiveButton, 0, wx.ALL|wx.EXPAND, 5)
 	fileSizer.Add(fileBox, 1, wx.ALL|wx.EXPAND, 5)
 	bSizerBottom.Add(fileSizer, 0, wx.ALL|wx.EXPAND, 5)
 
+	// the other half of a two-way session: where to save what's received when sending, or
+	// what to send back when receiving
+	duplexSizer := wx.NewBoxSizer(wx.HORIZONTAL)
+	duplexSendButton := wx.NewButton(mf.Panel, wx.ID_ANY, "Send File(s)", wx.DefaultPosition, wx.DefaultSize, 0)
+	duplexSendFolderButton := wx.NewButton(mf.Panel, wx.ID_ANY, "Send Folder", wx.DefaultPosition, wx.DefaultSize, 0)
+	duplexReceiveButton := wx.NewButton(mf.Panel, wx.ID_ANY, "Save To", wx.DefaultPosition, wx.DefaultSize, 0)
+	duplexFileBox := wx.NewTextCtrl(mf.Panel, wx.ID_ANY, "", wx.DefaultPosition, wx.DefaultSize, 0)
+	duplexSizer.Add(duplexSendButton, 0, wx.ALL|wx.EXPAND, 5)
+	duplexSizer.Add(duplexSendFolderButton, 0, wx.ALL|wx.EXPAND, 5)
+	duplexSizer.Add(duplexReceiveButton, 0, wx.ALL|wx.EXPAND, 5)
+	duplexSizer.Add(duplexFileBox, 1, wx.ALL|wx.EXPAND, 5)
+	bSizerBottom.Add(duplexSizer, 0, wx.ALL|wx.EXPAND, 5)
+	bSizerBottom.Hide(duplexSizer)
+
 	// start button
 	startButton := wx.NewButton(mf.Panel, wx.ID_ANY, "Start", wx.DefaultPosition, wx.DefaultSize, 0)
 	cancelButton := wx.NewButton(mf.Panel, wx.ID_ANY, "Cancel", wx.DefaultPosition, wx.DefaultSize, 0)
@@ -96,21 +144,77 @@ func newGui() *mainFrame {
 	/////////// ACTIONS //////////
 	//////////////////////////////
 
+	// shows the second file row and the receiving options when this end will be receiving
+	showDuplex := func() {
+		sending, duplex := radiobox2.GetSelection() == 0, duplexBox.GetValue()
+		bSizerBottom.Show(duplexSizer, duplex, true)
+		if duplex {
+			duplexSendButton.Show(!sending)
+			duplexSendFolderButton.Show(!sending)
+			duplexReceiveButton.Show(sending)
+		}
+		conflictBox.Show(!sending || duplex)
+		keepPartialBox.Show(!sending || duplex)
+		mf.Panel.Layout()
+	}
+
 	// mode button action
 	wx.Bind(mf, wx.EVT_RADIOBOX, func(e wx.Event) {
+		usr, _ := user.Current()
+		desktop := usr.HomeDir + string(os.PathSeparator) + "Desktop" + string(os.PathSeparator)
+		duplexFileList = nil
 		if radiobox2.GetSelection() == 0 {
 			receiveButton.Hide()
 			sendButton.Show()
+			sendFolderButton.Show()
 			fileBox.SetValue("")
+			duplexFileBox.SetValue(desktop)
 		} else if radiobox2.GetSelection() == 1 {
 			sendButton.Hide()
+			sendFolderButton.Hide()
 			receiveButton.Show()
-			usr, _ := user.Current()
-			fileBox.SetValue(usr.HomeDir + string(os.PathSeparator) + "Desktop" + string(os.PathSeparator))
+			fileBox.SetValue(desktop)
+			duplexFileBox.SetValue("")
 		}
-		mf.Panel.Layout()
+		showDuplex()
 	}, radiobox2.GetId())
 
+	// two-way action
+	wx.Bind(mf, wx.EVT_CHECKBOX, func(e wx.Event) {
+		if radiobox2.GetSelection() == 0 && duplexFileBox.GetValue() == "" {
+			usr, _ := user.Current()
+			duplexFileBox.SetValue(usr.HomeDir + string(os.PathSeparator) + "Desktop" + string(os.PathSeparator))
+		}
+		showDuplex()
+	}, duplexBox.GetId())
+
+	// conflict policy action
+	wx.Bind(mf, wx.EVT_RADIOBOX, func(e wx.Event) {
+		s := loadSettings()
+		s.OnConflict = conflictPolicies[conflictBox.GetSelection()]
+		if err := saveSettings(s); err != nil {
+			outputBox.AppendText("\nCould not save settings: " + err.Error())
+		}
+	}, conflictBox.GetId())
+
+	// keep partial files action
+	wx.Bind(mf, wx.EVT_CHECKBOX, func(e wx.Event) {
+		s := loadSettings()
+		s.KeepPartial = keepPartialBox.GetValue()
+		if err := saveSettings(s); err != nil {
+			outputBox.AppendText("\nCould not save settings: " + err.Error())
+		}
+	}, keepPartialBox.GetId())
+
+	// extended attributes action
+	wx.Bind(mf, wx.EVT_CHECKBOX, func(e wx.Event) {
+		s := loadSettings()
+		s.Xattrs = xattrsBox.GetValue()
+		if err := saveSettings(s); err != nil {
+			outputBox.AppendText("\nCould not save settings: " + err.Error())
+		}
+	}, xattrsBox.GetId())
+
 	// send button action
 	wx.Bind(mf, wx.EVT_BUTTON, func(e wx.Event) {
 		fd := wx.NewFileDialogT(wx.NullWindow, "Select Files", "", "", "*", wx.FD_MULTIPLE, wx.DefaultPosition, wx.DefaultSize, "Open")
@@ -127,6 +231,15 @@ func newGui() *mainFrame {
 		}
 	}, sendButton.GetId())
 
+	// send folder button action
+	wx.Bind(mf, wx.EVT_BUTTON, func(e wx.Event) {
+		fd := wx.NewDirDialogT(wx.NullWindow, "Select Folder", "Open", wx.DD_DEFAULT_STYLE, wx.DefaultPosition, wx.DefaultSize)
+		if fd.ShowModal() != wx.ID_CANCEL {
+			fileList = []string{fd.GetPath()}
+			fileBox.SetValue(fileList[0])
+		}
+	}, sendFolderButton.GetId())
+
 	// receive button action
 	wx.Bind(mf, wx.EVT_BUTTON, func(e wx.Event) {
 		fd := wx.NewDirDialogT(wx.NullWindow, "Select Folder", "Open", wx.DD_DEFAULT_STYLE, wx.DefaultPosition, wx.DefaultSize)
@@ -143,6 +256,38 @@ func newGui() *mainFrame {
 		}
 	}, receiveButton.GetId())
 
+	// two-way send button action
+	wx.Bind(mf, wx.EVT_BUTTON, func(e wx.Event) {
+		fd := wx.NewFileDialogT(wx.NullWindow, "Select Files", "", "", "*", wx.FD_MULTIPLE, wx.DefaultPosition, wx.DefaultSize, "Open")
+		if fd.ShowModal() != wx.ID_CANCEL {
+			duplexFileList = []string{}
+			fd.GetPaths(&duplexFileList)
+			if len(duplexFileList) == 1 {
+				duplexFileBox.SetValue(duplexFileList[0])
+			} else {
+				duplexFileBox.SetValue(multipleFileString)
+			}
+		}
+	}, duplexSendButton.GetId())
+
+	// two-way send folder button action
+	wx.Bind(mf, wx.EVT_BUTTON, func(e wx.Event) {
+		fd := wx.NewDirDialogT(wx.NullWindow, "Select Folder", "Open", wx.DD_DEFAULT_STYLE, wx.DefaultPosition, wx.DefaultSize)
+		if fd.ShowModal() != wx.ID_CANCEL {
+			duplexFileList = []string{fd.GetPath()}
+			duplexFileBox.SetValue(duplexFileList[0])
+		}
+	}, duplexSendFolderButton.GetId())
+
+	// two-way receive button action
+	wx.Bind(mf, wx.EVT_BUTTON, func(e wx.Event) {
+		fd := wx.NewDirDialogT(wx.NullWindow, "Select Folder", "Open", wx.DD_DEFAULT_STYLE, wx.DefaultPosition, wx.DefaultSize)
+		fd.SetPath(duplexFileBox.GetValue())
+		if fd.ShowModal() != wx.ID_CANCEL {
+			duplexFileBox.SetValue(fd.GetPath() + string(os.PathSeparator))
+		}
+	}, duplexReceiveButton.GetId())
+
 	// start button action
 	wx.Bind(mf, wx.EVT_BUTTON, func(e wx.Event) {
 		mode, peer := "", ""
@@ -161,14 +306,19 @@ func newGui() *mainFrame {
 
 		ctx, cancelCtx := context.WithCancel(context.Background())
 		t = Transfer{
-			Filepath:  fileBox.GetValue(),
-			FileList:  fileList,
-			Mode:      mode,
-			Port:      3290,
-			Peer:      peer,
-			Frame:     mf,
-			Ctx:       ctx,
-			CancelCtx: cancelCtx,
+			Filepath:    fileBox.GetValue(),
+			FileList:    fileList,
+			Mode:        mode,
+			Port:        defaultPort,
+			Peer:        peer,
+			Link:        adHocLink{beaconTargets: broadcastTargets},
+			OnConflict:  conflictPolicies[conflictBox.GetSelection()],
+			KeepPartial: keepPartialBox.GetValue(),
+			Xattrs:      xattrsBox.GetValue(),
+			Duplex:      duplexBox.GetValue(),
+			UI:          &wxUI{frame: mf, receiving: mode == "receiving"},
+			Ctx:         ctx,
+			CancelCtx:   cancelCtx,
 		}
 		// if only one file in fileList, let t.Filepath remain equal to contents of fileBox
 		// because user might have made manual change to text before hitting start.
@@ -177,17 +327,34 @@ func newGui() *mainFrame {
 		if len(fileList) == 1 {
 			t.FileList[0] = t.Filepath
 		}
+		// the other half of a two-way session, chosen in the second row
+		if t.Mode == "receiving" {
+			t.FileList = nil
+			if t.Duplex && len(duplexFileList) == 1 {
+				t.FileList = []string{duplexFileBox.GetValue()}
+			} else if t.Duplex {
+				t.FileList = duplexFileList
+			}
+		} else if t.Duplex {
+			folder := duplexFileBox.GetValue()
+			if fpStat, err := os.Stat(folder); err != nil || !fpStat.IsDir() {
+				t.output("Please select valid folder to save received files in.")
+				return
+			}
+			t.Destination = filepath.Clean(folder) + string(os.PathSeparator)
+		}
 
-		if t.Mode == "sending" {
-			// make sure all files exist
-			for _, file := range t.FileList {
-				_, err := os.Stat(file)
-				if err != nil {
-					t.output("Could not find output file " + file)
-					t.output(err.Error())
-					return
-				}
+		// make sure all files exist
+		for _, file := range t.FileList {
+			_, err := os.Stat(file)
+			if err != nil {
+				t.output("Could not find output file " + file)
+				t.output(err.Error())
+				return
 			}
+		}
+
+		if t.Mode == "sending" {
 			pd := wx.NewTextEntryDialog(mf.Panel, "Enter password from receiving end:", "", "", wx.OK|wx.CANCEL, wx.DefaultPosition)
 			ret := pd.ShowModal()
 			if ret != wx.ID_OK {
@@ -261,6 +428,38 @@ func newGui() *mainFrame {
 		dialog.ShowModal()
 	}, popUpPassword)
 
+	// accept offered files event
+	wx.Bind(mf, wx.EVT_THREAD, func(e wx.Event) {
+		threadEvent := wx.ToThreadEvent(e)
+		dialog := wx.NewMultiChoiceDialog(mf.Panel, threadEvent.GetString(), "Accept Files?", mf.reviewChoices, wx.CHOICEDLG_STYLE, wx.DefaultPosition)
+		all := make([]int, len(mf.reviewChoices))
+		for i := range all {
+			all[i] = i
+		}
+		dialog.SetSelections(all)
+		answer := make([]bool, len(mf.reviewChoices))
+		if dialog.ShowModal() == wx.ID_OK {
+			for _, i := range dialog.GetSelections() {
+				answer[i] = true
+			}
+		}
+		go func() { mf.reviewAnswers <- answer }()
+	}, reviewFiles)
+
+	// file already exists event
+	wx.Bind(mf, wx.EVT_THREAD, func(e wx.Event) {
+		threadEvent := wx.ToThreadEvent(e)
+		dialog := wx.NewMessageDialog(mf.Panel, threadEvent.GetString()+" is already there.\n\nOverwrite it? Press No to keep both, or Cancel to skip it.", "File Exists", wx.YES_NO|wx.CANCEL, wx.DefaultPosition)
+		answer := conflictSkip
+		switch dialog.ShowModal() {
+		case wx.ID_YES:
+			answer = conflictOverwrite
+		case wx.ID_NO:
+			answer = conflictRename
+		}
+		go func() { mf.conflictAnswers <- answer }()
+	}, resolveConflict)
+
 	mf.Panel.SetSizer(bSizerTotal)
 	mf.Layout()
 	mf.Centre(wx.BOTH)
@@ -292,10 +491,24 @@ func newGui() *mainFrame {
 	return mf
 }
 
-func (t *Transfer) output(msg string) {
+func runGui() {
+	wx1 := wx.NewApp("Flying Carpet")
+	mf := newGui()
+	mf.Show()
+	wx1.MainLoop()
+}
+
+// wxUI passes the transfer's progress to the window as thread events, since wx widgets can
+// only be touched from the main loop.
+type wxUI struct {
+	frame     *mainFrame
+	receiving bool
+}
+
+func (u *wxUI) Output(msg string) {
 	threadEvt := wx.NewThreadEvent(wx.EVT_THREAD, outputBoxUpdate)
 	threadEvt.SetString(msg)
-	t.Frame.QueueEvent(threadEvt)
+	u.frame.QueueEvent(threadEvt)
 
 	//for testing
 	// file, err := os.OpenFile("err.txt", os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
@@ -307,9 +520,60 @@ func (t *Transfer) output(msg string) {
 	// file.WriteString("\r\n")
 }
 
-func enableStartButton(t *Transfer) {
+func (u *wxUI) ShowPassword(password string) {
+	showPassphraseEvt := wx.NewThreadEvent(wx.EVT_THREAD, popUpPassword)
+	showPassphraseEvt.SetString(password)
+	u.frame.QueueEvent(showPassphraseEvt)
+}
+
+// ReviewFiles lists what's on offer, all ticked, and waits for the user to pick which to accept.
+// Cancelling the dialog declines everything.
+func (u *wxUI) ReviewFiles(entries []manifestEntry, totalSize int64) []bool {
+	choices := make([]string, len(entries))
+	for i, e := range entries {
+		if e.Mode.IsDir() {
+			choices[i] = e.RelPath + "/"
+		} else {
+			choices[i] = fmt.Sprintf("%s (%s)", e.RelPath, makeSizeReadable(e.Size))
+		}
+	}
+	u.frame.reviewChoices = choices
+	reviewEvt := wx.NewThreadEvent(wx.EVT_THREAD, reviewFiles)
+	reviewEvt.SetString(fmt.Sprintf("The sending end is offering %d, %s in all.\nUntick any you don't want:", len(entries), makeSizeReadable(totalSize)))
+	u.frame.QueueEvent(reviewEvt)
+	return <-u.frame.reviewAnswers
+}
+
+// ResolveConflict asks the user what to do about a file that's already there, and waits for the answer.
+func (u *wxUI) ResolveConflict(path string) conflictPolicy {
+	conflictEvt := wx.NewThreadEvent(wx.EVT_THREAD, resolveConflict)
+	conflictEvt.SetString(path)
+	u.frame.QueueEvent(conflictEvt)
+	return <-u.frame.conflictAnswers
+}
+
+func (u *wxUI) FileStarted(path string) {
+	progressEvt := wx.NewThreadEvent(wx.EVT_THREAD, progressBarShow)
+	u.frame.QueueEvent(progressEvt)
+	// the sending end's file box already shows what the user picked
+	if u.receiving {
+		filenameEvt := wx.NewThreadEvent(wx.EVT_THREAD, receiveFileUpdate)
+		filenameEvt.SetString(path)
+		u.frame.QueueEvent(filenameEvt)
+	}
+}
+
+func (u *wxUI) Progress(percentage int) {
+	progressEvt := wx.NewThreadEvent(wx.EVT_THREAD, progressBarUpdate)
+	progressEvt.SetInt(percentage)
+	u.frame.QueueEvent(progressEvt)
+}
+
+func (u *wxUI) FileFinished(path string) {}
+
+func (u *wxUI) TransferFinished(err error) {
 	startButtonEvt := wx.NewThreadEvent(wx.EVT_THREAD, startButtonEnable)
-	t.Frame.QueueEvent(startButtonEvt)
+	u.frame.QueueEvent(startButtonEvt)
 }
 
 const website = "https://github.com/spieglt/flyingcarpet"
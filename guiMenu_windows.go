@@ -1,3 +1,6 @@
+//go:build !nogui
+// +build !nogui
+
 package main
 
 import "github.com/dontpanic92/wxGo/wx"
@@ -0,0 +1,15 @@
+//go:build nogui
+// +build nogui
+
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+// Built with -tags nogui, Flying Carpet leaves out wxWidgets and only runs from the command line.
+func runGui() {
+	fmt.Fprint(os.Stderr, "This build of Flying Carpet has no graphical interface.\n\n"+cliUsage)
+	os.Exit(exitUsage)
+}
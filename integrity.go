@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"hash"
+	"io"
+	"os"
+)
+
+// Integrity checking. Both ends hash each file as it streams through: a SHA-256 of the
+// whole file, plus a SHA-256 of every chunk. The chunk hashes are combined into a Merkle
+// root, which lets the two ends check that the part of a file the receiving end already
+// has from an interrupted transfer matches what the sending end has, without re-sending
+// it. The sending end puts both values in a trailer after the last chunk, and the
+// receiving end compares them to its own.
+
+const trailerSize = 2 * sha256.Size
+
+// ack statuses
+const (
+	ackOK byte = iota
+	ackIntegrityFailed
+	ackSaveFailed
+)
+
+const quarantineSuffix = ".flyingcarpet.corrupt"
+
+type fileHasher struct {
+	full   hash.Hash
+	chunks [][]byte
+}
+
+func newFileHasher() *fileHasher {
+	return &fileHasher{full: sha256.New()}
+}
+
+// add hashes the next chunk of the file and returns the chunk's own hash.
+func (h *fileHasher) add(chunk []byte) []byte {
+	h.full.Write(chunk)
+	sum := sha256.Sum256(chunk)
+	h.chunks = append(h.chunks, sum[:])
+	return sum[:]
+}
+
+func (h *fileHasher) fileHash() []byte {
+	return h.full.Sum(nil)
+}
+
+// trailer is the whole-file hash followed by the Merkle root of the chunk hashes.
+func (h *fileHasher) trailer() []byte {
+	return append(h.fileHash(), merkleRoot(h.chunks)...)
+}
+
+func (h *fileHasher) matches(trailer []byte) bool {
+	return bytes.Equal(h.trailer(), trailer)
+}
+
+// merkleRoot combines chunk hashes pairwise until one is left. Interior nodes are prefixed
+// with a byte so they can't be confused with chunk hashes, and an odd node out at any level
+// is carried up as-is.
+func merkleRoot(leaves [][]byte) []byte {
+	if len(leaves) == 0 {
+		sum := sha256.Sum256(nil)
+		return sum[:]
+	}
+	level := leaves
+	for len(level) > 1 {
+		var next [][]byte
+		for i := 0; i < len(level); i += 2 {
+			if i+1 == len(level) {
+				next = append(next, level[i])
+				continue
+			}
+			h := sha256.New()
+			h.Write([]byte{1})
+			h.Write(level[i])
+			h.Write(level[i+1])
+			next = append(next, h.Sum(nil))
+		}
+		level = next
+	}
+	return level[0]
+}
+
+// hashFile is the SHA-256 of the whole file at path.
+func hashFile(path string) ([]byte, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	h := sha256.New()
+	if _, err = io.Copy(h, file); err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
+
+// quarantine moves a file that failed verification, received at path in place of final, out
+// of the way so nobody mistakes it for the real thing.
+func quarantine(t *Transfer, path, final string) {
+	if err := os.Rename(path, final+quarantineSuffix); err != nil {
+		t.output("Could not quarantine " + path + ", deleting it: " + err.Error())
+		os.Remove(path)
+		return
+	}
+	t.output("File that failed verification was moved to " + final + quarantineSuffix)
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/godbus/dbus/v5"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// A backend for iwd, talking to it over the system D-Bus. See
+// https://git.kernel.org/pub/scm/network/wireless/iwd.git/tree/doc for the API.
+
+const iwdDest = "net.connman.iwd"
+
+// iwdObjects is what GetManagedObjects returns: each object's interfaces and their properties.
+type iwdObjects map[dbus.ObjectPath]map[string]map[string]dbus.Variant
+
+type iwdClient struct {
+	object func(path dbus.ObjectPath) dbusObject
+}
+
+func (c *iwdClient) call(path dbus.ObjectPath, method string, args []interface{}, results ...interface{}) error {
+	if err := c.object(path).Call(method, args, results...); err != nil {
+		return fmt.Errorf("iwd %s failed: %s", method, err)
+	}
+	return nil
+}
+
+func (c *iwdClient) objects() (objects iwdObjects, err error) {
+	err = c.call("/", "org.freedesktop.DBus.ObjectManager.GetManagedObjects", nil, &objects)
+	return
+}
+
+// device finds the first WiFi device iwd manages.
+func (c *iwdClient) device() (device dbus.ObjectPath, iface string, err error) {
+	objects, err := c.objects()
+	if err != nil {
+		return
+	}
+	for path, ifaces := range objects {
+		if props, ok := ifaces[iwdDest+".Device"]; ok {
+			iface, _ = props["Name"].Value().(string)
+			return path, iface, nil
+		}
+	}
+	return "", "", errors.New("Could not find a WiFi device managed by iwd.")
+}
+
+// network finds the network called ssid that device can see, or "" if it can't.
+func (c *iwdClient) network(device dbus.ObjectPath, ssid string) dbus.ObjectPath {
+	objects, err := c.objects()
+	if err != nil {
+		return ""
+	}
+	for path, ifaces := range objects {
+		props, ok := ifaces[iwdDest+".Network"]
+		if ok && props["Name"].Value() == ssid && props["Device"].Value() == device {
+			return path
+		}
+	}
+	return ""
+}
+
+// setMode switches device between "station" and "ap".
+func (c *iwdClient) setMode(device dbus.ObjectPath, mode string) error {
+	return c.call(device, "org.freedesktop.DBus.Properties.Set", []interface{}{iwdDest + ".Device", "Mode", dbus.MakeVariant(mode)})
+}
+
+// connectedNetwork is the name of the network device is on, or "" if it isn't on one.
+func (c *iwdClient) connectedNetwork(device dbus.ObjectPath) string {
+	v, err := c.object(device).Property(iwdDest + ".Station.ConnectedNetwork")
+	if err != nil {
+		return ""
+	}
+	network, _ := v.(dbus.ObjectPath)
+	if network == "" || network == "/" {
+		return ""
+	}
+	name, _ := c.object(network).Property(iwdDest + ".Network.Name")
+	s, _ := name.(string)
+	return s
+}
+
+// pskFile is where iwd looks for the password of the network called ssid. Names that aren't
+// plain are hex encoded.
+func (b iwdBackend) pskFile(ssid string) string {
+	name := ssid
+	for _, r := range ssid {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == ' ' || r == '_' || r == '-') {
+			name = "=" + hex.EncodeToString([]byte(ssid))
+			break
+		}
+	}
+	return filepath.Join(b.stateDir, name+".psk")
+}
+
+// iwdBackend sets up the ad hoc network with iwd. Like wpaBackend, it hands out addresses itself.
+type iwdBackend struct {
+	hostTools
+	c *iwdClient
+	// where iwd keeps the passwords of known networks
+	stateDir string
+}
+
+func (iwdBackend) name() string { return "iwd" }
+
+func (b iwdBackend) startAdHoc(t *Transfer) error {
+	device, iface, err := b.c.device()
+	if err != nil {
+		return err
+	}
+	if err = b.c.setMode(device, "ap"); err != nil {
+		return err
+	}
+	if err = b.c.call(device, iwdDest+".AccessPoint.Start", []interface{}{t.SSID, t.Passphrase + t.Passphrase}); err != nil {
+		return errors.New("Could not start ad hoc network " + t.SSID + ". Does your WiFi card support access point mode? " + err.Error())
+	}
+	if err = b.hostAddresses(t, iface); err != nil {
+		return err
+	}
+	t.output("Started ad hoc network " + t.SSID + ".")
+	return nil
+}
+
+func (b iwdBackend) joinAdHoc(t *Transfer) error {
+	timeout := joinAdHocTimeout
+	device, iface, err := b.c.device()
+	if err != nil {
+		return err
+	}
+	// iwd only connects to a WPA network without asking for a password if it already knows it
+	if err = ioutil.WriteFile(b.pskFile(t.SSID), []byte("[Security]\nPassphrase="+t.Passphrase+t.Passphrase+"\n"), 0600); err != nil {
+		return fmt.Errorf("Could not give iwd the network's password: %s", err)
+	}
+	for {
+		select {
+		case <-t.Ctx.Done():
+			return errors.New("Exiting joinAdHoc, transfer was canceled.")
+		default:
+		}
+		// a scan already in progress is fine
+		b.c.call(device, iwdDest+".Station.Scan", nil)
+		if network := b.c.network(device, t.SSID); network != "" {
+			if err = b.c.call(network, iwdDest+".Network.Connect", nil); err == nil {
+				if err = b.waitForAddress(t, iface); err != nil {
+					return err
+				}
+				t.output("Joined ad hoc network " + t.SSID + ".")
+				return nil
+			}
+			t.output(fmt.Sprintf("Error joining ad hoc network: %s", err))
+		}
+		if timeout <= 0 {
+			return errors.New("Could not find the ad hoc network within " + strconv.Itoa(joinAdHocTimeout) + " seconds.")
+		}
+		timeout -= 5
+		b.sleep(time.Second * time.Duration(5))
+	}
+}
+
+func (b iwdBackend) resetWifi(t *Transfer) {
+	device, iface, err := b.c.device()
+	if err != nil {
+		t.output(err.Error())
+		return
+	}
+	if mode, err := b.c.object(device).Property(iwdDest + ".Device.Mode"); err == nil && mode == "ap" {
+		if err = b.c.call(device, iwdDest+".AccessPoint.Stop", nil); err != nil {
+			t.output("Error stopping ad hoc network: " + err.Error())
+		}
+		if err = b.c.setMode(device, "station"); err != nil {
+			t.output(err.Error())
+		}
+		b.stopHosting(iface)
+	}
+	// forgetting the network disconnects from it
+	if err = os.Remove(b.pskFile(t.SSID)); err != nil && !os.IsNotExist(err) {
+		t.output("Error removing ad hoc network: " + err.Error())
+	}
+	if t.PreviousSSID == "" || b.c.connectedNetwork(device) == t.PreviousSSID {
+		return
+	}
+	b.c.call(device, iwdDest+".Station.Scan", nil)
+	network := b.c.network(device, t.PreviousSSID)
+	if network == "" {
+		err = errors.New(t.PreviousSSID + " is out of range.")
+	} else {
+		err = b.c.call(network, iwdDest+".Network.Connect", nil)
+	}
+	if err != nil {
+		t.output("Error rejoining previous network: " + err.Error())
+	}
+}
+
+// the network's name, which is what it's found by again
+func (b iwdBackend) currentConnection() string { return b.currentSSID() }
+
+func (b iwdBackend) currentSSID() string {
+	device, _, err := b.c.device()
+	if err != nil {
+		return ""
+	}
+	return b.c.connectedNetwork(device)
+}
+
+func (b iwdBackend) wifiInterface() (iface string) {
+	_, iface, _ = b.c.device()
+	return
+}
+
+func (b iwdBackend) ipAddress() string { return b.ipv4(b.wifiInterface()) }
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"errors"
+	"github.com/godbus/dbus/v5"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const fakeIwdDevice = dbus.ObjectPath("/net/connman/iwd/0/4")
+
+const fakeIwdHome = dbus.ObjectPath("/net/connman/iwd/0/4/486f6d65_psk")
+
+// fakeIwd answers the D-Bus calls the iwd client makes the way iwd would, for a WiFi card
+// connected to a network called Home.
+type fakeIwd struct {
+	fakeBus
+	// iwd's state directory, where known networks' passwords go
+	dir string
+	// how many scans it takes for the ad hoc network to show up
+	scansToAppear int
+	scans         int
+	started       []interface{}
+	connected     []dbus.ObjectPath
+}
+
+func newFakeIwd(dir string) *fakeIwd {
+	f := &fakeIwd{fakeBus: fakeBus{objects: map[dbus.ObjectPath]*fakeDBusObject{}}, dir: dir}
+	f.objects["/"] = &fakeDBusObject{methods: map[string]func([]interface{}) ([]interface{}, error){
+		"org.freedesktop.DBus.ObjectManager.GetManagedObjects": f.getManagedObjects,
+	}}
+	f.objects[fakeIwdDevice] = &fakeDBusObject{
+		props: map[string]interface{}{
+			iwdDest + ".Device.Name":              "wlan0",
+			iwdDest + ".Device.Mode":              "station",
+			iwdDest + ".Station.State":            "connected",
+			iwdDest + ".Station.ConnectedNetwork": fakeIwdHome,
+		},
+		methods: map[string]func([]interface{}) ([]interface{}, error){
+			"org.freedesktop.DBus.Properties.Set": f.setProperty,
+			iwdDest + ".Station.Scan":             f.scan,
+			iwdDest + ".AccessPoint.Start":        f.startAccessPoint,
+			iwdDest + ".AccessPoint.Stop": func([]interface{}) ([]interface{}, error) {
+				return nil, nil
+			},
+		},
+	}
+	f.addNetwork(fakeIwdHome, "Home")
+	return f
+}
+
+// backend is an iwdBackend that talks to f and runs commands with tools.
+func (f *fakeIwd) backend(tools hostTools) iwdBackend {
+	return iwdBackend{tools, &iwdClient{object: f.object}, f.dir}
+}
+
+func (f *fakeIwd) addNetwork(path dbus.ObjectPath, name string) {
+	f.objects[path] = &fakeDBusObject{
+		props: map[string]interface{}{
+			iwdDest + ".Network.Name":   name,
+			iwdDest + ".Network.Device": fakeIwdDevice,
+		},
+		methods: map[string]func([]interface{}) ([]interface{}, error){
+			// like iwd without an agent, only known networks can be connected to
+			iwdDest + ".Network.Connect": func([]interface{}) ([]interface{}, error) {
+				if name != "Home" {
+					if _, err := os.Stat(f.backend(hostTools{}).pskFile(name)); err != nil {
+						return nil, errors.New("net.connman.iwd.NoAgent")
+					}
+				}
+				f.lock.Lock()
+				defer f.lock.Unlock()
+				f.connected = append(f.connected, path)
+				f.objects[fakeIwdDevice].props[iwdDest+".Station.ConnectedNetwork"] = path
+				return nil, nil
+			},
+		},
+	}
+}
+
+// getManagedObjects groups each object's properties by interface.
+func (f *fakeIwd) getManagedObjects([]interface{}) ([]interface{}, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	objects := iwdObjects{}
+	for path, obj := range f.objects {
+		for name, v := range obj.props {
+			i := strings.LastIndex(name, ".")
+			if objects[path] == nil {
+				objects[path] = map[string]map[string]dbus.Variant{}
+			}
+			if objects[path][name[:i]] == nil {
+				objects[path][name[:i]] = map[string]dbus.Variant{}
+			}
+			objects[path][name[:i]][name[i+1:]] = dbus.MakeVariant(v)
+		}
+	}
+	return []interface{}{objects}, nil
+}
+
+func (f *fakeIwd) setProperty(args []interface{}) ([]interface{}, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	name := args[0].(string) + "." + args[1].(string)
+	f.objects[fakeIwdDevice].props[name] = args[2].(dbus.Variant).Value()
+	return nil, nil
+}
+
+func (f *fakeIwd) scan([]interface{}) ([]interface{}, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.scans++; f.scans == f.scansToAppear {
+		f.addNetwork("/net/connman/iwd/0/4/adhoc_psk", "flyingCarpet_selftest")
+	}
+	return nil, nil
+}
+
+func (f *fakeIwd) startAccessPoint(args []interface{}) ([]interface{}, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.objects[fakeIwdDevice].props[iwdDest+".Device.Mode"] != "ap" {
+		return nil, errors.New("net.connman.iwd.NotAvailable")
+	}
+	f.started = args
+	return nil, nil
+}
+
+func TestIwdStartAdHoc(t *testing.T) {
+	dir := t.TempDir()
+	f := newFakeIwd(dir)
+	r := &scriptedRunner{script: []scriptedCommand{
+		{match: "ip addr add"},
+		{match: "command -v dnsmasq", err: errors.New("exit status 1")},
+	}}
+	b := f.backend(r.tools())
+	tr, ui := newNetworkTestTransfer("receiving", "linux")
+	if err := b.startAdHoc(tr); err != nil {
+		t.Fatal(err)
+	}
+	if len(f.started) != 2 || f.started[0] != tr.SSID || f.started[1] != "testtest" {
+		t.Fatalf("expected access point %s with password testtest, got %q", tr.SSID, f.started)
+	}
+	if r.count("ip addr add 10.42.0.1/24 dev wlan0") != 1 {
+		t.Fatalf("expected the hosting address to be added, ran %q", r.ran)
+	}
+	if !ui.contains("dnsmasq is not installed") {
+		t.Fatal("missing dnsmasq was not reported")
+	}
+}
+
+func TestIwdJoinAdHoc(t *testing.T) {
+	dir := t.TempDir()
+	f := newFakeIwd(dir)
+	f.scansToAppear = 3
+	r := &scriptedRunner{}
+	tools := r.tools()
+	tools.ipv4 = func(string) string { return "10.42.0.57" }
+	b := f.backend(tools)
+
+	tr, _ := newNetworkTestTransfer("sending", "linux")
+	tr.SSID = "flyingCarpet_selftest"
+	if err := b.joinAdHoc(tr); err != nil {
+		t.Fatal(err)
+	}
+	if f.scans != 3 || r.slept != 10*time.Second {
+		t.Fatalf("expected 3 scans 5s apart, got %d in %s", f.scans, r.slept)
+	}
+	psk, err := ioutil.ReadFile(filepath.Join(dir, "flyingCarpet_selftest.psk"))
+	if err != nil || !strings.Contains(string(psk), "Passphrase=testtest") {
+		t.Fatalf("expected iwd to be given the password, got %q, %v", psk, err)
+	}
+	if b.currentSSID() != tr.SSID {
+		t.Fatalf("expected to be on %s, on %q", tr.SSID, b.currentSSID())
+	}
+}
+
+func TestIwdResetWifi(t *testing.T) {
+	dir := t.TempDir()
+	f := newFakeIwd(dir)
+	r := &scriptedRunner{script: []scriptedCommand{
+		{match: "ip addr add"},
+		{match: "command -v dnsmasq", err: errors.New("exit status 1")},
+		{match: "ip addr del"},
+	}}
+	b := f.backend(r.tools())
+
+	// hosting
+	tr, ui := newNetworkTestTransfer("receiving", "mac")
+	tr.PreviousSSID = b.currentConnection()
+	if tr.PreviousSSID != "Home" {
+		t.Fatalf("expected current network Home, got %q", tr.PreviousSSID)
+	}
+	if err := b.startAdHoc(tr); err != nil {
+		t.Fatal(err)
+	}
+	f.objects[fakeIwdDevice].props[iwdDest+".Station.ConnectedNetwork"] = dbus.ObjectPath("/")
+	b.resetWifi(tr)
+	if mode := f.objects[fakeIwdDevice].props[iwdDest+".Device.Mode"]; mode != "station" {
+		t.Fatalf("expected the card back in station mode, got %v", mode)
+	}
+	if r.count("ip addr del 10.42.0.1/24 dev wlan0") != 1 {
+		t.Fatalf("expected the hosting address to be removed, ran %q", r.ran)
+	}
+	if len(f.connected) != 1 || f.connected[0] != fakeIwdHome {
+		t.Fatalf("expected to rejoin Home, connected to %q (%q)", f.connected, ui.lines)
+	}
+
+	// joined: the password iwd was given is removed
+	psk := b.pskFile(tr.SSID)
+	if err := ioutil.WriteFile(psk, []byte("[Security]\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	b.resetWifi(tr)
+	if _, err := os.Stat(psk); !os.IsNotExist(err) {
+		t.Fatal("iwd's copy of the password was not removed")
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"io"
+	"os"
+)
+
+const journalSuffix = ".flyingcarpet.journal"
+
+// partSuffix marks a file that's still being received. It gets its real name once it's
+// complete and verified.
+const partSuffix = ".flyingcarpet.part"
+const journalMagic = "FCJ2"
+const journalHeaderSize = int64(len(journalMagic) + 8)
+const journalRecordSize = int64(8 + sha256.Size)
+
+// A journal sits next to a file being received and records which chunks of it have
+// been received, decrypted, and written, so an interrupted transfer can pick up where
+// it left off. It starts with a magic number and the size of the file being received,
+// and each record after that is the index of a chunk that made it to disk, followed by
+// the SHA-256 of that chunk so it can be checked before the transfer is resumed.
+type journal struct {
+	file     *os.File
+	fileSize int64
+	hashes   [][]byte // hashes of the contiguous chunks from the start of the file on disk
+}
+
+func journalPath(path string) string {
+	return path + journalSuffix
+}
+
+// loadJournal opens the journal for the partial file at path, if there is one. A journal
+// for a file of a different size is ignored.
+func loadJournal(path string, fileSize int64) (j *journal, found bool) {
+	file, err := os.OpenFile(journalPath(path), os.O_RDWR, 0666)
+	if err != nil {
+		return nil, false
+	}
+	header := make([]byte, journalHeaderSize)
+	if _, err = io.ReadFull(file, header); err != nil || string(header[:len(journalMagic)]) != journalMagic ||
+		int64(binary.BigEndian.Uint64(header[len(journalMagic):])) != fileSize {
+		file.Close()
+		return nil, false
+	}
+	j = &journal{file: file, fileSize: fileSize}
+	record := make([]byte, journalRecordSize)
+	for {
+		if _, err = io.ReadFull(file, record); err != nil {
+			break
+		}
+		// chunks are written in order, so anything out of sequence means the journal is damaged
+		if int64(binary.BigEndian.Uint64(record)) != int64(len(j.hashes)) {
+			break
+		}
+		j.hashes = append(j.hashes, append([]byte(nil), record[8:]...))
+	}
+	if err = j.truncate(len(j.hashes)); err != nil {
+		file.Close()
+		return nil, false
+	}
+	return j, true
+}
+
+// newJournal starts a fresh journal for the file at path, replacing any old one.
+func newJournal(path string, fileSize int64) (*journal, error) {
+	file, err := os.OpenFile(journalPath(path), os.O_CREATE|os.O_RDWR|os.O_TRUNC, 0666)
+	if err != nil {
+		return nil, newTransferError(errLocalIO, "Error creating transfer journal:", err)
+	}
+	header := make([]byte, journalHeaderSize)
+	copy(header, journalMagic)
+	binary.BigEndian.PutUint64(header[len(journalMagic):], uint64(fileSize))
+	if _, err = file.Write(header); err != nil {
+		file.Close()
+		return nil, newTransferError(errLocalIO, "Error writing transfer journal:", err)
+	}
+	return &journal{file: file, fileSize: fileSize}, nil
+}
+
+// resumeOffset is the byte offset in the file at which the transfer should continue.
+func (j *journal) resumeOffset() int64 {
+	return min(int64(len(j.hashes))*CHUNKSIZE, j.fileSize)
+}
+
+// record notes that the next chunk, with the given hash, has been written to the file.
+func (j *journal) record(hash []byte) error {
+	record := make([]byte, 8, journalRecordSize)
+	binary.BigEndian.PutUint64(record, uint64(len(j.hashes)))
+	record = append(record, hash...)
+	if _, err := j.file.Write(record); err != nil {
+		return newTransferError(errLocalIO, "Error writing transfer journal:", err)
+	}
+	j.hashes = append(j.hashes, hash)
+	return nil
+}
+
+// truncate forgets all but the first n chunks, so new records follow on from them.
+func (j *journal) truncate(n int) error {
+	j.hashes = j.hashes[:n]
+	size := journalHeaderSize + journalRecordSize*int64(n)
+	if err := j.file.Truncate(size); err != nil {
+		return newTransferError(errLocalIO, "Error writing transfer journal:", err)
+	}
+	if _, err := j.file.Seek(size, io.SeekStart); err != nil {
+		return newTransferError(errLocalIO, "Error writing transfer journal:", err)
+	}
+	return nil
+}
+
+func (j *journal) close() {
+	j.file.Close()
+}
+
+// remove deletes the journal once the file it describes is complete.
+func (j *journal) remove() {
+	j.file.Close()
+	os.Remove(j.file.Name())
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"runtime"
+)
+
+// A Link gets the two computers onto a network where the sending end can reach the receiving
+// end over TCP. Everything after that, from the protocol preamble on, is the same whatever
+// the link.
+type Link interface {
+	// Establish brings up the link on this end.
+	Establish(t *Transfer) error
+	// Announce makes the receiving end findable by PeerAddress until stop is called. Only
+	// called on the receiving end, while it waits for the sending end to connect.
+	Announce(t *Transfer) (stop func())
+	// PeerAddress finds the receiving end's IP address, and its port if the link can tell.
+	// Only called on the sending end.
+	PeerAddress(t *Transfer) (string, error)
+	// Teardown undoes whatever Establish changed. It's called even if Establish failed.
+	Teardown(t *Transfer)
+}
+
+// links that can be chosen by name, e.g. from the command line
+var linkNames = []string{"adhoc", "lan", "loopback"}
+
+func newLink(name string) (Link, error) {
+	switch name {
+	case "adhoc":
+		return adHocLink{beaconTargets: broadcastTargets}, nil
+	case "lan":
+		return lanLink{mdns: zeroconfResponder{}}, nil
+	case "loopback":
+		return loopbackLink{}, nil
+	}
+	return nil, errors.New("Unknown link " + name + ".")
+}
+
+// adHocLink is the original Flying Carpet link: one end hosts an ad hoc WiFi network, the
+// other joins it, and the user's previous network is restored afterwards. The details depend
+// on the OS at each end and live in the network_*.go files.
+type adHocLink struct {
+	// beaconTargets lists the networks to announce the receiving end on
+	beaconTargets func() []beaconTarget
+}
+
+func (adHocLink) Establish(t *Transfer) error {
+	if runtime.GOOS == "windows" && t.Mode == "sending" {
+		t.PreviousSSID = getCurrentWifi(t)
+	} else if runtime.GOOS == "linux" {
+		t.PreviousSSID = getCurrentUUID(t)
+	}
+	return connectToPeer(t)
+}
+
+func (l adHocLink) Announce(t *Transfer) func() { return announce(t, l.beaconTargets) }
+
+func (adHocLink) PeerAddress(t *Transfer) (string, error) {
+	return discoverPeer(t)
+}
+
+func (adHocLink) Teardown(t *Transfer) {
+	// stop the goroutine keeping a Mac on the ad hoc network. if a Mac is receiving from
+	// a Mac, it's hosting the network and there's no such goroutine.
+	if runtime.GOOS == "darwin" && (t.Mode == "sending" || t.Peer == "windows" || t.Peer == "linux") {
+		t.CancelCtx()
+	}
+	resetWifi(t)
+}
+
+// lanLink is for two computers already on the same network: Ethernet, a USB network link, or
+// an existing LAN. Nothing is changed, so there's nothing to restore. The sending end finds
+// the receiving end over mDNS, unless it's given its address in t.RecipientIP.
+type lanLink struct {
+	mdns mdnsResponder
+}
+
+func (lanLink) Establish(t *Transfer) error {
+	if t.Mode == "receiving" {
+		if addrs := localAddresses(); len(addrs) > 0 {
+			t.output("This computer's addresses:")
+			for _, addr := range addrs {
+				t.output("    " + addr)
+			}
+		}
+	}
+	return nil
+}
+
+func (l lanLink) Announce(t *Transfer) func() { return advertise(t, l.mdns) }
+
+func (l lanLink) PeerAddress(t *Transfer) (string, error) {
+	if t.RecipientIP == "" {
+		return browseForPeer(t, l.mdns)
+	}
+	return t.RecipientIP, nil
+}
+
+func (lanLink) Teardown(t *Transfer) {}
+
+// loopbackLink connects to a receiving end on the same computer, for trying things out and
+// end-to-end testing.
+type loopbackLink struct{}
+
+func (loopbackLink) Establish(t *Transfer) error { return nil }
+
+func (loopbackLink) Announce(t *Transfer) func() { return func() {} }
+
+func (loopbackLink) PeerAddress(t *Transfer) (string, error) { return "127.0.0.1", nil }
+
+func (loopbackLink) Teardown(t *Transfer) {}
+
+// localAddresses lists this computer's non-loopback IP addresses, for the user to give to the sending end.
+func localAddresses() (addrs []string) {
+	ifaceAddrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return nil
+	}
+	for _, a := range ifaceAddrs {
+		if ipNet, ok := a.(*net.IPNet); ok && !ipNet.IP.IsLoopback() && !ipNet.IP.IsLinkLocalUnicast() {
+			addrs = append(addrs, ipNet.IP.String())
+		}
+	}
+	return
+}
@@ -2,86 +2,109 @@ package main
 
 import (
 	"context"
-	"crypto/md5"
+	"crypto/rand"
+	"encoding/hex"
 	"errors"
 	"fmt"
-	"github.com/dontpanic92/wxGo/wx"
-	"math/rand"
+	"math/big"
 	"net"
-	"runtime"
+	"os"
 	"strconv"
+	"strings"
 	"time"
 )
 
 const dialTimeout = 60
+
+// defaultPort is where the receiving end listens unless told otherwise.
+const defaultPort = 3290
 const joinAdHocTimeout = 60
-const findMacTimeout = 60
 
 // The Transfer struct holds transfer-specific data used throughout program.
 // Should reorganize/clean this up but not sure how best to do so.
 type Transfer struct {
 	Filepath     string
 	FileList     []string
+	Entries      []fileEntry
+	RelPath      string
+	Destination  string
+	AutoAccept   bool // receive everything the sending end offers without asking
+	OnConflict   conflictPolicy
+	KeepPartial  bool // if a file isn't received completely, keep what was so it can be resumed
+	Xattrs       bool // copy extended attributes too, if the peer agrees
 	Passphrase   string
+	Key          *[32]byte
 	SSID         string
 	RecipientIP  string
 	Peer         string // "mac", "windows", or "linux"
-	Mode         string // "sending" or "receiving"
+	Mode         string // "sending" or "receiving". in a two-way session, which end dials and which listens
+	Duplex       bool   // both ends send and receive, if the peer agrees
 	PreviousSSID string
 	Port         int
+	Link         Link
+	Capabilities uint32
 	AdHocCapable bool
+	Streams      int // data streams to send file contents over; 1 sends them with everything else
+	StreamConns  []net.Conn
+	DialStream   func() (net.Conn, error)
+	AcceptStream func() (net.Conn, error)
+	FreeSpace    func(path string) (int64, error) // how much room is left where path is. nil asks the disk
 	Ctx          context.Context
 	CancelCtx    context.CancelFunc
 	WfdSendChan  chan string
 	WfdRecvChan  chan string
-	Frame        *mainFrame
+	UI           UI
+	warned       map[string]bool // problems already reported this session, see warnOnce
+	preambles    []byte          // both ends' preambles, the dialer's first, for the key exchange to authenticate
 }
 
 func main() {
-	wx1 := wx.NewApp("Flying Carpet")
-	mf := newGui()
-	mf.Show()
-	wx1.MainLoop()
-	return
+	if len(os.Args) > 1 {
+		os.Exit(runCli(os.Args[1:]))
+	}
+	runGui()
 }
 
-func mainRoutine(t *Transfer) {
+// mainRoutine runs a whole transfer, start to finish, and returns whatever stopped it early.
+// Errors are reported to the user as they happen, the return value is for callers like the
+// CLI that need to know how things went.
+func mainRoutine(t *Transfer) (err error) {
 	t.WfdSendChan, t.WfdRecvChan = make(chan string), make(chan string)
-	var err error
 
-	// cleanup
+	// cleanup. recover so that an unexpected panic still gets the user back on their network.
 	defer func() {
-		enableStartButton(t)
-		resetWifi(t)
+		if r := recover(); r != nil {
+			err = fmt.Errorf("Unexpected error: %v", r)
+			t.output(err.Error())
+		}
+		t.Link.Teardown(t)
+		t.UI.TransferFinished(err)
 	}()
 
 	if t.Mode == "sending" {
-		// to stop searching for ad hoc network (if Mac jumps off)
-		defer func() {
-			if runtime.GOOS == "darwin" {
-				t.CancelCtx()
-			}
-		}()
-
-		pwBytes := md5.Sum([]byte(t.Passphrase))
-		prefix := pwBytes[:3]
-		t.SSID = fmt.Sprintf("flyingCarpet_%x", prefix)
-
-		if runtime.GOOS == "windows" {
-			t.PreviousSSID = getCurrentWifi(t)
-		} else if runtime.GOOS == "linux" {
-			t.PreviousSSID = getCurrentUUID(t)
+		var networkID string
+		if networkID, t.Passphrase, err = splitPassword(t.Passphrase); err != nil {
+			t.output(err.Error())
+			t.output("Aborting transfer.")
+			return
 		}
+		t.SSID = "flyingCarpet_" + networkID
 
 		// make ip connection
-		if err = connectToPeer(t); err != nil {
+		if err = t.Link.Establish(t); err != nil {
+			t.output(err.Error())
+			t.output("Aborting transfer.")
+			return
+		}
+		if t.RecipientIP, err = t.Link.PeerAddress(t); err != nil {
 			t.output(err.Error())
 			t.output("Aborting transfer.")
 			return
 		}
 
 		// make tcp connection
-		conn, err := dialPeer(t)
+		var conn *net.Conn
+		conn, err = dialPeer(t)
 		if conn != nil {
 			defer (*conn).Close()
 		}
@@ -91,116 +114,266 @@ func mainRoutine(t *Transfer) {
 			return
 		}
 		t.output("Connected")
-
-		// tell receiving end how many files we're sending
-		if err = sendCount(conn, t); err != nil {
-			t.output("Could not send number of files: " + err.Error())
-			return
+		t.DialStream = func() (net.Conn, error) {
+			return net.DialTimeout("tcp", t.RecipientIP+":"+strconv.Itoa(t.Port), 5*time.Second)
 		}
 
-		// send files
-		for i, v := range t.FileList {
-			if len(t.FileList) > 1 {
-				t.output("=============================")
-				t.output(fmt.Sprintf("Beginning transfer %d of %d. Filename: %s", i+1, len(t.FileList), v))
-			}
-			t.Filepath = v
-			if err = chunkAndSend(conn, t); err != nil {
-				t.output(err.Error())
-				t.output("Aborting transfer.")
-				return
-			}
+		if err = sendFiles(conn, t); err != nil {
+			reportError(t, err)
+			return
 		}
 
 		t.output("Send complete, resetting WiFi and exiting.")
 
 	} else if t.Mode == "receiving" {
-		defer func() {
-			// why the && here? because if we're on darwin and receiving from darwin, we'll be hosting the adhoc and thus haven't joined it,
-			// and thus don't need to shut down the goroutine trying to stay on it. does this need to happen when peer is linux? yes.
-			if runtime.GOOS == "darwin" && (t.Peer == "windows" || t.Peer == "linux") {
-				t.CancelCtx()
-			}
-		}()
-
+		networkID := generateNetworkID()
 		t.Passphrase = generatePassword()
-		pwBytes := md5.Sum([]byte(t.Passphrase))
-		prefix := pwBytes[:3]
-		t.SSID = fmt.Sprintf("flyingCarpet_%x", prefix)
+		t.SSID = "flyingCarpet_" + networkID
 
-		showPassphraseEvt := wx.NewThreadEvent(wx.EVT_THREAD, popUpPassword)
-		showPassphraseEvt.SetString(t.Passphrase)
-		t.Frame.QueueEvent(showPassphraseEvt)
+		// the network ID goes in front of the password, so the user has one thing to type
+		shown := networkID + "-" + t.Passphrase
+		t.UI.ShowPassword(shown)
 		t.output(fmt.Sprintf("=============================\n"+
 			"Transfer password: %s\nPlease use this password on sending end when prompted to start transfer.\n"+
-			"=============================\n", t.Passphrase))
+			"=============================\n", shown))
+
+		// pick the port before bringing up the link, which may need to know it
+		var listener *net.TCPListener
+		if listener, err = listenForPeer(t); err != nil {
+			t.output(err.Error())
+			t.output("Aborting transfer.")
+			return
+		}
+		defer func() {
+			if err := listener.Close(); err != nil {
+				t.output("Error closing TCP listener: " + err.Error())
+			}
+		}()
 
 		// make ip connection
-		if err = connectToPeer(t); err != nil {
+		if err = t.Link.Establish(t); err != nil {
 			t.output(err.Error())
 			t.output("Aborting transfer.")
 			return
 		}
 
 		// make tcp connection
-		listener, conn, err := listenForPeer(t)
-		// wait till end to close listener and tcp connection for multi-file transfers
-		// need to defer one func that closes both iff each != nil
+		var conn *net.Conn
+		if conn, err = acceptPeer(t, listener); err != nil {
+			t.output(err.Error())
+			t.output("Aborting transfer.")
+			return
+		}
+		// wait till end to close tcp connection for multi-file transfers
 		defer func() {
-			if conn != nil {
-				if err := (*conn).Close(); err != nil {
-					t.output("Error closing TCP connection: " + err.Error())
-				}
-
-			}
-			if listener != nil {
-				if err := (*listener).Close(); err != nil {
-					t.output("Error closing TCP listener: " + err.Error())
-				}
+			if err := (*conn).Close(); err != nil {
+				t.output("Error closing TCP connection: " + err.Error())
 			}
 		}()
 
-		if err != nil {
-			t.output(err.Error())
-			t.output("Aborting transfer.")
+		t.AcceptStream = func() (net.Conn, error) {
+			listener.SetDeadline(time.Now().Add(time.Second))
+			return listener.Accept()
+		}
+
+		if err = receiveFiles(conn, t); err != nil {
+			reportError(t, err)
 			return
 		}
 
-		// find out how many files we're receiving
-		numFiles, err := receiveCount(conn, t)
+		t.output("Reception complete, resetting WiFi and exiting.")
+	}
+	return
+}
+
+// sendFiles runs the sending end of a session over an established TCP connection: protocol
+// negotiation, key exchange, and every file and folder in t.FileList.
+func sendFiles(conn *net.Conn, t *Transfer) (err error) {
+	// make sure we speak the same protocol
+	if err = negotiateProtocol(conn, t); err != nil {
+		return
+	}
+
+	// agree on session key, proving we both know the password
+	if err = initiateKeyExchange(conn, t); err != nil {
+		return
+	}
+
+	if t.hasCapability(capDuplex) {
+		return exchangeFiles(conn, t)
+	}
+	if t.Duplex {
+		t.output("The receiving end isn't set up for a two-way session, so files will only be sent.")
+	}
+	*conn = newSealedConn(*conn, t.Key, sealSession, true)
+	return sendEntries(conn, t)
+}
+
+// sendEntries sends every file and folder in t.FileList over a connection the key exchange
+// has been done on.
+func sendEntries(conn *net.Conn, t *Transfer) (err error) {
+	// open any extra data streams
+	defer closeStreams(t)
+	if err = openStreams(conn, t); err != nil {
+		return
+	}
+
+	// tell receiving end how many files we're sending
+	if t.Entries, err = expandFileList(t); err != nil {
+		return
+	}
+	if !t.hasCapability(capDirectories) {
+		for _, e := range t.Entries {
+			if e.IsDir {
+				return errors.New("The receiving end's version of Flying Carpet can't receive folders. Please select files instead.")
+			}
+		}
+	}
+	if err = sendCount(conn, t); err != nil {
+		return
+	}
+
+	// let the receiving end see what's coming and pick what it wants
+	if t.hasCapability(capManifest) && len(t.Entries) > 0 {
+		if t.Entries, err = offerEntries(*conn, t); err != nil {
+			return
+		}
+		if len(t.Entries) == 0 {
+			t.output("The receiving end declined everything.")
+			return
+		}
+	}
+
+	// send files
+	for i, e := range t.Entries {
+		if len(t.Entries) > 1 {
+			t.output("=============================")
+			t.output(fmt.Sprintf("Beginning transfer %d of %d. Filename: %s", i+1, len(t.Entries), e.RelPath))
+		}
+		t.Filepath, t.RelPath = e.Path, e.RelPath
+		if e.IsDir {
+			err = sendDirectory(conn, t)
+		} else {
+			err = chunkAndSend(conn, t)
+		}
 		if err != nil {
-			t.output("Could not receive number of files: " + err.Error())
 			return
 		}
+	}
+	return
+}
 
-		// receive files
-		for i := 0; i < numFiles; i++ {
-			if numFiles > 1 {
-				t.output("=============================")
-				t.output(fmt.Sprintf("Receiving file %d of %d.", i+1, numFiles))
-			}
-			if err = receiveAndAssemble(conn, t); err != nil {
-				t.output(err.Error())
-				t.output("Aborting transfer.")
-				return
-			}
+// receiveFiles runs the receiving end of a session over an established TCP connection, saving
+// everything under the folder in t.Filepath.
+func receiveFiles(conn *net.Conn, t *Transfer) (err error) {
+	// make sure we speak the same protocol
+	if err = negotiateProtocol(conn, t); err != nil {
+		return
+	}
+
+	// agree on session key, proving we both know the password
+	if err = respondKeyExchange(conn, t); err != nil {
+		return
+	}
+
+	t.Destination = t.Filepath
+	if t.hasCapability(capDuplex) {
+		return exchangeFiles(conn, t)
+	}
+	if t.Duplex && len(t.FileList) > 0 {
+		t.output("The sending end isn't set up for a two-way session, so files will only be received.")
+	}
+	*conn = newSealedConn(*conn, t.Key, sealSession, false)
+	return receiveEntries(conn, t)
+}
+
+// receiveEntries receives files and folders over a connection the key exchange has been done
+// on, saving them under t.Destination.
+func receiveEntries(conn *net.Conn, t *Transfer) (err error) {
+	// wait for any extra data streams
+	defer closeStreams(t)
+	if err = acceptStreams(conn, t); err != nil {
+		return
+	}
+
+	// find out how many files we're receiving
+	numFiles, err := receiveCount(conn, t)
+	if err != nil {
+		return
+	}
+
+	// see what's coming and pick what we want
+	var accepted []manifestEntry
+	if t.hasCapability(capManifest) && numFiles > 0 {
+		if accepted, err = reviewEntries(*conn, t, numFiles); err != nil {
+			return
+		}
+		if len(accepted) == 0 {
+			t.output("Declined everything.")
+			return
 		}
+		numFiles = len(accepted)
+	}
 
-		t.output("Reception complete, resetting WiFi and exiting.")
+	// receive files
+	for i := 0; i < numFiles; i++ {
+		if numFiles > 1 {
+			t.output("=============================")
+			t.output(fmt.Sprintf("Receiving file %d of %d.", i+1, numFiles))
+		}
+		var expected *manifestEntry
+		if accepted != nil {
+			expected = &accepted[i]
+		}
+		if err = receiveAndAssemble(conn, t, expected); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// reportError tells the user what went wrong and, for errors from the transfer pipeline, what it means.
+func reportError(t *Transfer, err error) {
+	t.output(err.Error())
+	switch {
+	case isErrorKind(err, errBadPassword):
+		t.output("Please start the transfer again on both ends and re-enter the password.")
+	case isErrorKind(err, errTamperedChunk):
+		t.output("Received data could not be verified. The transfer may have been interfered with.")
+	case isErrorKind(err, errTruncatedStream):
+		t.output("Lost connection to peer.")
+	case isErrorKind(err, errLocalIO):
+		t.output("Could not read or write a local file. Check that the file or folder is accessible and the disk isn't full.")
 	}
+	t.output("Aborting transfer.")
 }
 
-func listenForPeer(t *Transfer) (*net.TCPListener, *net.Conn, error) {
+// listenForPeer listens on t.Port, or any free port if it's 0, and sets t.Port to the port
+// it got. If something else has the default port, it picks another: the link tells the
+// sending end which.
+func listenForPeer(t *Transfer) (*net.TCPListener, error) {
 	ln, err := net.ListenTCP("tcp", &net.TCPAddr{Port: t.Port})
+	if err != nil && t.Port == defaultPort {
+		t.output(fmt.Sprintf("Port %d is in use, listening on another.", defaultPort))
+		ln, err = net.ListenTCP("tcp", &net.TCPAddr{})
+	}
 	if err != nil {
-		return nil, nil, fmt.Errorf("Could not listen on :%d. Err: %s", t.Port, err)
+		return nil, fmt.Errorf("Could not listen on :%d. Err: %s", t.Port, err)
 	}
+	t.Port = ln.Addr().(*net.TCPAddr).Port
 	t.output("Listening on :" + strconv.Itoa(t.Port))
+	return ln, nil
+}
+
+// acceptPeer waits for the sending end to connect, announcing this end on the link meanwhile.
+func acceptPeer(t *Transfer, ln *net.TCPListener) (*net.Conn, error) {
+	stop := t.Link.Announce(t)
+	defer stop()
 
 	for {
 		select {
 		case <-t.Ctx.Done():
-			return nil, nil, errors.New("Exiting listenForPeer, transfer was canceled.")
+			return nil, errors.New("Exiting acceptPeer, transfer was canceled.")
 		default:
 			ln.SetDeadline(time.Now().Add(time.Second))
 			conn, err := ln.Accept()
@@ -209,7 +382,7 @@ func listenForPeer(t *Transfer) (*net.TCPListener, *net.Conn, error) {
 				continue
 			}
 			t.output("Connection accepted")
-			return ln, &conn, nil
+			return &conn, nil
 		}
 	}
 }
@@ -237,13 +410,47 @@ func dialPeer(t *Transfer) (*net.Conn, error) {
 	return nil, fmt.Errorf("Waited %d seconds, no connection.", dialTimeout)
 }
 
+// passwordLength is how many characters of generatePassword's alphabet make a password: about
+// 58 bits, so that even what an eavesdropper can capture of the WiFi handshake, which tests
+// guesses offline, isn't worth trying.
+const passwordLength = 10
+
+// networkIDSize is how many random bytes name the ad hoc network, as hex.
+const networkIDSize = 3
+
 func generatePassword() string {
 	// no l, I, or O because they look too similar to each other, 1, and 0
 	const chars = "0123456789abcdefghijkmnopqrstuvwxyzABCDEFGHJKLMNPQRSTUVWXYZ"
-	rand.Seed(time.Now().UTC().UnixNano())
-	pwBytes := make([]byte, 4)
+	pwBytes := make([]byte, passwordLength)
 	for i := range pwBytes {
-		pwBytes[i] = chars[rand.Intn(len(chars))]
+		n, err := rand.Int(rand.Reader, big.NewInt(int64(len(chars))))
+		if err != nil {
+			panic(err)
+		}
+		pwBytes[i] = chars[n.Int64()]
 	}
 	return string(pwBytes)
 }
+
+// generateNetworkID names this transfer's network. It's broadcast in the SSID, so it's
+// random rather than anything to do with the password.
+func generateNetworkID() string {
+	id := make([]byte, networkIDSize)
+	if _, err := rand.Read(id); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(id)
+}
+
+// splitPassword splits what the receiving end shows as the password into the network ID and
+// the password proper.
+func splitPassword(shown string) (networkID, password string, err error) {
+	networkID, password, found := strings.Cut(strings.TrimSpace(shown), "-")
+	if !found || len(networkID) != 2*networkIDSize || password == "" {
+		return "", "", newTransferError(errBadPassword, "Please enter the whole password shown on the receiving end, including the part before the dash.", nil)
+	}
+	if _, err = hex.DecodeString(networkID); err != nil {
+		return "", "", newTransferError(errBadPassword, "Please enter the whole password shown on the receiving end, including the part before the dash.", nil)
+	}
+	return strings.ToLower(networkID), password, nil
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestGeneratePassword(t *testing.T) {
+	seen := map[string]bool{}
+	for i := 0; i < 100; i++ {
+		pw := generatePassword()
+		if len(pw) != passwordLength || strings.ContainsAny(pw, "lIO-") {
+			t.Fatalf("bad password %q", pw)
+		}
+		if seen[pw] {
+			t.Fatalf("password %q generated twice", pw)
+		}
+		seen[pw] = true
+	}
+}
+
+func TestSplitPassword(t *testing.T) {
+	id, pw, err := splitPassword(" 0A1b2c-abcdEFGH23\n")
+	if err != nil || id != "0a1b2c" || pw != "abcdEFGH23" {
+		t.Fatalf("expected 0a1b2c and abcdEFGH23, got %q, %q, %v", id, pw, err)
+	}
+	for _, shown := range []string{"abcdEFGH23", "-abcdEFGH23", "0a1b2c-", "0a1b2-abcdEFGH23", "0a1b2z-abcdEFGH23"} {
+		if _, _, err := splitPassword(shown); !isErrorKind(err, errBadPassword) {
+			t.Fatalf("%q should have been refused, got: %v", shown, err)
+		}
+	}
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+)
+
+// Manifests. Once the sending end has said how many entries it's sending, it lists them all
+// before any file data: each one's relative path, mode, size, and SHA-256 if it has one. The
+// receiving end checks the paths, decides which entries it wants (asking the user unless
+// it accepts everything automatically), and works out what to do about the ones it already
+// has. It then asks for the SHA-256 of any of those it might skip if they're identical (a
+// bitmap, often empty), makes sure it has room for the rest, and answers with a bitmap of
+// the ones it accepted. Only those are sent.
+
+// the most manifest data put in one frame. longer manifests are split over several.
+const maxManifestFrame = 256 * 1024
+
+// answers to a manifest
+const (
+	offerAnswered byte = iota
+	offerNoSpace
+)
+
+// manifestEntry is one file or folder the sending end is offering.
+type manifestEntry struct {
+	RelPath string
+	Mode    os.FileMode
+	Size    int64
+	Hash    []byte // SHA-256 of the file's contents, or nil if the sending end didn't compute it
+
+	onConflict conflictPolicy // on the receiving end, what to do if the file's already there
+}
+
+// offerEntries lists t.Entries for the receiving end and returns the ones it accepted.
+func offerEntries(conn net.Conn, t *Transfer) ([]fileEntry, error) {
+	var frame []byte
+	for _, e := range t.Entries {
+		info, err := os.Stat(e.Path)
+		if err != nil {
+			return nil, newTransferError(errLocalIO, "Could not find "+e.Path+":", err)
+		}
+		m := manifestEntry{RelPath: e.RelPath, Mode: info.Mode()}
+		if !e.IsDir {
+			m.Size = info.Size()
+		}
+		encoded := encodeManifestEntry(m)
+		if len(frame)+len(encoded) > maxManifestFrame {
+			if err = writeFrame(conn, frameManifest, frame); err != nil {
+				return nil, streamError("Error transmitting list of files:", err)
+			}
+			frame = nil
+		}
+		frame = append(frame, encoded...)
+	}
+	if len(frame) > 0 {
+		if err := writeFrame(conn, frameManifest, frame); err != nil {
+			return nil, streamError("Error transmitting list of files:", err)
+		}
+	}
+
+	t.output("Waiting for the receiving end to accept the files.")
+	if err := sendRequestedHashes(conn, t); err != nil {
+		return nil, err
+	}
+	answer, err := expectFrame(conn, frameSelection, "accepted files")
+	if err != nil {
+		return nil, err
+	}
+	if len(answer) != 1+(len(t.Entries)+7)/8 {
+		return nil, newTransferError(errTamperedChunk, "Received malformed list of accepted files.", nil)
+	}
+	if answer[0] == offerNoSpace {
+		return nil, errors.New("The receiving end doesn't have enough free space for the files it accepted.")
+	}
+	var accepted []fileEntry
+	for i, e := range t.Entries {
+		if answer[1+i/8]&(1<<uint(i%8)) != 0 {
+			accepted = append(accepted, e)
+		}
+	}
+	if declined := len(t.Entries) - len(accepted); declined > 0 {
+		t.output(fmt.Sprintf("The receiving end declined %d of %d.", declined, len(t.Entries)))
+	}
+	return accepted, nil
+}
+
+// sendRequestedHashes hashes the entries the receiving end asked about and sends it the results.
+func sendRequestedHashes(conn net.Conn, t *Transfer) error {
+	request, err := expectFrame(conn, frameHashRequest, "hash request")
+	if err != nil {
+		return err
+	}
+	if len(request) != (len(t.Entries)+7)/8 {
+		return newTransferError(errTamperedChunk, "Received malformed hash request.", nil)
+	}
+	var hashes []byte
+	for i, e := range t.Entries {
+		if request[i/8]&(1<<uint(i%8)) == 0 || e.IsDir {
+			continue
+		}
+		t.output("Receiving end already has a file named " + e.RelPath + ", checking if it's the same.")
+		hash, err := hashFile(e.Path)
+		if err != nil {
+			return newTransferError(errLocalIO, "Error reading out file:", err)
+		}
+		hashes = append(hashes, hash...)
+	}
+	if err = writeFrame(conn, frameHashes, hashes); err != nil {
+		return streamError("Error transmitting file hashes:", err)
+	}
+	return nil
+}
+
+// requestHashes asks the sending end for the hashes of the entries marked in need, and
+// fills them in.
+func requestHashes(conn net.Conn, t *Transfer, entries []manifestEntry, need []bool) error {
+	request := make([]byte, (len(entries)+7)/8)
+	requested := 0
+	for i := range entries {
+		if need[i] {
+			request[i/8] |= 1 << uint(i%8)
+			requested++
+		}
+	}
+	if err := writeFrame(conn, frameHashRequest, request); err != nil {
+		return streamError("Error requesting file hashes:", err)
+	}
+	hashes, err := expectFrame(conn, frameHashes, "file hashes")
+	if err != nil {
+		return err
+	}
+	if len(hashes) != requested*sha256.Size {
+		return newTransferError(errTamperedChunk, "Received malformed file hashes.", nil)
+	}
+	for i := range entries {
+		if need[i] {
+			entries[i].Hash, hashes = hashes[:sha256.Size], hashes[sha256.Size:]
+		}
+	}
+	return nil
+}
+
+// reviewEntries reads the sending end's manifest of count entries, decides which to accept,
+// and tells the sending end. It returns the accepted entries, in the order they'll arrive.
+func reviewEntries(conn net.Conn, t *Transfer, count int) ([]manifestEntry, error) {
+	var entries []manifestEntry
+	var total int64
+	for len(entries) < count {
+		frame, err := expectFrame(conn, frameManifest, "list of files")
+		if err != nil {
+			return nil, err
+		}
+		for len(frame) > 0 && len(entries) < count {
+			var m manifestEntry
+			if m, frame, err = decodeManifestEntry(frame); err != nil {
+				return nil, err
+			}
+			if _, err = safeJoin(t.Destination, m.RelPath); err != nil {
+				return nil, err
+			}
+			entries = append(entries, m)
+			total += m.Size
+		}
+		if len(frame) > 0 {
+			return nil, newTransferError(errTamperedChunk, "Received more files than the sending end said it would send.", nil)
+		}
+	}
+
+	var accept []bool
+	if t.AutoAccept {
+		accept = make([]bool, len(entries))
+		for i := range accept {
+			accept[i] = true
+		}
+	} else if len(entries) > 0 {
+		answered := make(chan []bool, 1)
+		go func() { answered <- t.UI.ReviewFiles(entries, total) }()
+		select {
+		case accept = <-answered:
+		case <-t.Ctx.Done():
+			return nil, errors.New("Exiting reviewEntries, transfer was canceled.")
+		}
+	}
+	if len(accept) < len(entries) {
+		accept = append(accept, make([]bool, len(entries)-len(accept))...)
+	}
+
+	// deal with the ones that are already here
+	needHashes, err := resolveConflicts(t, entries, accept)
+	if err != nil {
+		return nil, err
+	}
+	if err = requestHashes(conn, t, entries, needHashes); err != nil {
+		return nil, err
+	}
+	skipIdentical(t, entries, accept)
+
+	var accepted []manifestEntry
+	var needed int64
+	answer := make([]byte, 1+(len(entries)+7)/8)
+	for i, m := range entries {
+		if accept[i] {
+			answer[1+i/8] |= 1 << uint(i%8)
+			accepted = append(accepted, m)
+			needed += m.Size
+		}
+	}
+
+	// refuse now rather than running out of room halfway through
+	if free, err := t.freeSpace(t.Destination); err == nil && needed > free {
+		answer[0] = offerNoSpace
+		writeFrame(conn, frameSelection, answer)
+		return nil, newTransferError(errLocalIO, fmt.Sprintf("Not enough free space in %s: the accepted files need %s and only %s is free.",
+			t.Destination, makeSizeReadable(needed), makeSizeReadable(free)), nil)
+	}
+	if err := writeFrame(conn, frameSelection, answer); err != nil {
+		return nil, streamError("Error transmitting accepted files:", err)
+	}
+	if len(accepted) < len(entries) {
+		t.output(fmt.Sprintf("Accepted %d of %d.", len(accepted), len(entries)))
+	}
+	return accepted, nil
+}
+
+// freeSpace is how many bytes can be written to the filesystem holding path.
+func (t *Transfer) freeSpace(path string) (int64, error) {
+	if t.FreeSpace != nil {
+		return t.FreeSpace(path)
+	}
+	return diskFreeSpace(path)
+}
+
+func encodeManifestEntry(m manifestEntry) []byte {
+	b := make([]byte, 17, 17+len(m.Hash)+2+len(m.RelPath))
+	binary.BigEndian.PutUint64(b[0:], uint64(m.Mode&(os.ModeDir|os.ModePerm)))
+	binary.BigEndian.PutUint64(b[8:], uint64(m.Size))
+	b[16] = byte(len(m.Hash))
+	b = append(b, m.Hash...)
+	b = append(b, byte(len(m.RelPath)>>8), byte(len(m.RelPath)))
+	return append(b, m.RelPath...)
+}
+
+// decodeManifestEntry reads the entry at the front of b and returns what's left after it.
+func decodeManifestEntry(b []byte) (m manifestEntry, rest []byte, err error) {
+	malformed := newTransferError(errTamperedChunk, "Received malformed list of files.", nil)
+	if len(b) < 17 {
+		return m, nil, malformed
+	}
+	m.Mode = os.FileMode(binary.BigEndian.Uint64(b[0:])) & (os.ModeDir | os.ModePerm)
+	m.Size = int64(binary.BigEndian.Uint64(b[8:]))
+	hashLen := int(b[16])
+	b = b[17:]
+	if m.Size < 0 || hashLen != 0 && hashLen != sha256.Size || len(b) < hashLen+2 {
+		return m, nil, malformed
+	}
+	if hashLen > 0 {
+		m.Hash = append([]byte(nil), b[:hashLen]...)
+	}
+	b = b[hashLen:]
+	pathLen := int(binary.BigEndian.Uint16(b))
+	b = b[2:]
+	if pathLen > maxFilenameLen || len(b) < pathLen {
+		return m, nil, malformed
+	}
+	m.RelPath = string(b[:pathLen])
+	return m, b[pathLen:], nil
+}
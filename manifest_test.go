@@ -0,0 +1,78 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDeclineFiles(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src")
+	sent := map[string][]byte{}
+	for name, size := range map[string]int{"keep.bin": CHUNKSIZE + 3, "skip.bin": 100, "folder/also-keep.txt": 10} {
+		data, err := writeRandomFile(filepath.Join(src, filepath.FromSlash(name)), size)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sent[name] = data
+	}
+	dest := filepath.Join(dir, "dest")
+	if err := os.Mkdir(dest, 0755); err != nil {
+		t.Fatal(err)
+	}
+	files := []string{filepath.Join(src, "keep.bin"), filepath.Join(src, "skip.bin"), filepath.Join(src, "folder")}
+	p := newTestPair(files, dest)
+	var offered []manifestEntry
+	var offeredSize int64
+	p.receiverUI.review = func(entries []manifestEntry, totalSize int64) []bool {
+		offered, offeredSize = entries, totalSize
+		accept := make([]bool, len(entries))
+		for i, e := range entries {
+			accept[i] = e.RelPath != "skip.bin"
+		}
+		return accept
+	}
+	if err := checkBothSucceeded(p.run()); err != nil {
+		t.Fatal(err)
+	}
+	if len(offered) != 4 || offeredSize != CHUNKSIZE+3+100+10 {
+		t.Fatalf("expected 4 entries and %d bytes offered, got %d and %d", CHUNKSIZE+3+100+10, len(offered), offeredSize)
+	}
+	if !p.senderUI.contains("declined 1 of 4") {
+		t.Fatal("sending end didn't report the declined file")
+	}
+	if _, err := os.Stat(filepath.Join(dest, "skip.bin")); err == nil {
+		t.Fatal("declined file was received anyway")
+	}
+	for _, name := range []string{"keep.bin", "folder/also-keep.txt"} {
+		if err := checkFile(filepath.Join(dest, filepath.FromSlash(name)), sent[name]); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestNoSpace(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src", "file.bin")
+	if _, err := writeRandomFile(src, CHUNKSIZE); err != nil {
+		t.Fatal(err)
+	}
+	dest := filepath.Join(dir, "dest")
+	if err := os.Mkdir(dest, 0755); err != nil {
+		t.Fatal(err)
+	}
+	p := newTestPair([]string{src}, dest)
+	p.receiver.FreeSpace = func(path string) (int64, error) { return CHUNKSIZE - 1, nil }
+	sendErr, recvErr := p.run()
+	if sendErr == nil || !strings.Contains(sendErr.Error(), "free space") {
+		t.Fatalf("sending end should have been told there's no room, got: %v", sendErr)
+	}
+	if !isErrorKind(recvErr, errLocalIO) {
+		t.Fatalf("receiving end should have refused for lack of space, got: %v", recvErr)
+	}
+	if _, err := os.Stat(filepath.Join(dest, "file.bin")); err == nil {
+		t.Fatal("file was started despite there being no room for it")
+	}
+}
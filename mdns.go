@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/grandcat/zeroconf"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Finding the receiving end on a network both computers are already on. The receiving end
+// advertises a DNS-SD service over multicast DNS with the transfer's SSID-style tag in its
+// TXT record, and the sending end browses for the one with its tag. Unlike the discovery
+// beacon, nothing here proves it came from the receiving end: it only gets the sending end
+// to a computer, and the key exchange decides whether it's the right transfer.
+
+const mdnsService = "_flyingcarpet._tcp"
+const mdnsDomain = "local."
+
+// mdnsEntry is one advertised instance of the service.
+type mdnsEntry struct {
+	instance string
+	text     []string
+	addrs    []net.IP
+	port     int
+}
+
+// mdnsResponder advertises and browses for the service. zeroconfResponder is the real one.
+type mdnsResponder interface {
+	// advertise advertises the service until stop is called.
+	advertise(instance string, port int, text []string) (stop func(), err error)
+	// browse sends the instances of the service it finds to found until ctx is done.
+	browse(ctx context.Context, found chan<- mdnsEntry) error
+}
+
+type zeroconfResponder struct{}
+
+func (zeroconfResponder) advertise(instance string, port int, text []string) (stop func(), err error) {
+	server, err := zeroconf.Register(instance, mdnsService, mdnsDomain, port, text, nil)
+	if err != nil {
+		return nil, err
+	}
+	return server.Shutdown, nil
+}
+
+func (zeroconfResponder) browse(ctx context.Context, found chan<- mdnsEntry) error {
+	resolver, err := zeroconf.NewResolver()
+	if err != nil {
+		return err
+	}
+	entries := make(chan *zeroconf.ServiceEntry)
+	go func() {
+		// closed by the resolver when ctx is done
+		for e := range entries {
+			select {
+			case found <- mdnsEntry{e.Instance, e.Text, e.AddrIPv4, e.Port}:
+			case <-ctx.Done():
+			}
+		}
+	}()
+	return resolver.Browse(ctx, mdnsService, mdnsDomain, entries)
+}
+
+// mdnsTag is the TXT record that identifies this transfer's receiving end.
+func mdnsTag(t *Transfer) string {
+	return "tag=" + t.SSID
+}
+
+// advertise makes the receiving end findable by browseForPeer until the returned function is called.
+func advertise(t *Transfer, m mdnsResponder) (stop func()) {
+	stop, err := m.advertise(t.SSID, t.Port, []string{mdnsTag(t)})
+	if err != nil {
+		t.output("Could not advertise this computer on the network: " + err.Error())
+		return func() {}
+	}
+	return stop
+}
+
+// browseForPeer finds the receiving end advertised for t, sets t.Port from it, and returns
+// its address.
+func browseForPeer(t *Transfer, m mdnsResponder) (string, error) {
+	ctx, cancel := context.WithTimeout(t.Ctx, discoveryTimeout*time.Second)
+	defer cancel()
+	found := make(chan mdnsEntry)
+	if err := m.browse(ctx, found); err != nil {
+		return "", fmt.Errorf("Could not look for the receiving end on the network: %s", err)
+	}
+	t.output("Looking for the receiving end on the network for " + strconv.Itoa(discoveryTimeout) + " seconds.")
+	for {
+		select {
+		case e := <-found:
+			if len(e.addrs) == 0 || !containsString(e.text, mdnsTag(t)) {
+				continue
+			}
+			t.Port = e.port
+			t.output(fmt.Sprintf("Peer IP found: %s", e.addrs[0]))
+			return e.addrs[0].String(), nil
+		case <-ctx.Done():
+			if t.Ctx.Err() != nil {
+				return "", errors.New("Exiting browseForPeer, transfer was canceled.")
+			}
+			return "", errors.New("Could not find the receiving end on the network within " + strconv.Itoa(discoveryTimeout) +
+				" seconds. Make sure both computers are on the same network, or give the receiving end's address.")
+		}
+	}
+}
+
+func containsString(list []string, s string) bool {
+	for _, l := range list {
+		if strings.TrimSpace(l) == s {
+			return true
+		}
+	}
+	return false
+}
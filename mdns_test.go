@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeMDNS is a network's worth of mDNS advertisements, kept in memory.
+type fakeMDNS struct {
+	lock    sync.Mutex
+	entries map[string]mdnsEntry
+}
+
+func (f *fakeMDNS) advertise(instance string, port int, text []string) (func(), error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.entries[instance] = mdnsEntry{instance, text, []net.IP{net.IPv4(127, 0, 0, 1)}, port}
+	return func() {
+		f.lock.Lock()
+		defer f.lock.Unlock()
+		delete(f.entries, instance)
+	}, nil
+}
+
+func (f *fakeMDNS) browse(ctx context.Context, found chan<- mdnsEntry) error {
+	f.lock.Lock()
+	var entries []mdnsEntry
+	for _, e := range f.entries {
+		entries = append(entries, e)
+	}
+	f.lock.Unlock()
+	go func() {
+		for _, e := range entries {
+			select {
+			case found <- e:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+func TestMDNS(t *testing.T) {
+	f := &fakeMDNS{entries: map[string]mdnsEntry{}}
+	// someone else's transfer on the same network
+	stranger := &Transfer{SSID: "flyingCarpet_000000", Port: 1111, UI: &recordingUI{}}
+	defer advertise(stranger, f)()
+
+	newEnd := func(mode string) *Transfer {
+		t := &Transfer{Mode: mode, SSID: "flyingCarpet_selftest", Port: 45678, Link: lanLink{mdns: f}, UI: &recordingUI{}}
+		t.Ctx, t.CancelCtx = context.WithCancel(context.Background())
+		return t
+	}
+	receiver, sender := newEnd("receiving"), newEnd("sending")
+	sender.Port = 0
+	stop := receiver.Link.Announce(receiver)
+	ip, err := sender.Link.PeerAddress(sender)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ip != "127.0.0.1" || sender.Port != 45678 {
+		t.Fatalf("expected to find 127.0.0.1:45678, found %s:%d", ip, sender.Port)
+	}
+
+	// once the receiving end stops advertising, there's nothing to find
+	stop()
+	if _, ok := f.entries[receiver.SSID]; ok {
+		t.Fatal("still advertised after stopping")
+	}
+	sender.CancelCtx()
+	if _, err = sender.Link.PeerAddress(sender); err == nil || !strings.Contains(err.Error(), "canceled") {
+		t.Fatalf("expected cancellation, got: %v", err)
+	}
+
+	// an address given by the user skips mDNS
+	sender.RecipientIP = "192.0.2.1"
+	if ip, err = sender.Link.PeerAddress(sender); err != nil || ip != "192.0.2.1" {
+		t.Fatalf("expected the given address, got %q, %v", ip, err)
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+	"time"
+)
+
+// File metadata. The per-file header always carries the permission bits. If both ends
+// support it, it also carries the modification time, and if both ends asked for them, the
+// file's extended attributes. The receiving end applies them once the file has its real
+// name, as far as its filesystem can represent them: FAT has no permissions and a coarse
+// clock, Windows only has a read-only flag, and not every filesystem takes extended
+// attributes. What can't be kept is reported once per session rather than once per file.
+
+// the most extended attribute data sent with one file
+const maxXattrBytes = 64 * 1024
+
+type fileMetadata struct {
+	Mode    os.FileMode
+	ModTime time.Time // zero if the sending end didn't send it
+	Xattrs  []xattr
+}
+
+type xattr struct {
+	Name  string
+	Value []byte
+}
+
+// readMetadata gathers what the peer can use of the file at path's metadata.
+func readMetadata(t *Transfer, path string, info os.FileInfo) fileMetadata {
+	meta := fileMetadata{Mode: info.Mode() & (os.ModeDir | os.ModePerm)}
+	if !t.hasCapability(capMetadata) {
+		return meta
+	}
+	meta.ModTime = info.ModTime()
+	if !t.hasCapability(capXattrs) {
+		return meta
+	}
+	xattrs, err := listXattrs(path)
+	if err != nil {
+		t.warnOnce("read xattrs", "Could not read extended attributes: "+err.Error())
+		return meta
+	}
+	size := 0
+	for _, x := range xattrs {
+		size += len(x.Name) + len(x.Value)
+		if size > maxXattrBytes {
+			t.output(fmt.Sprintf("%s has more than %s of extended attributes, sending only some.", path, makeSizeReadable(maxXattrBytes)))
+			break
+		}
+		meta.Xattrs = append(meta.Xattrs, x)
+	}
+	return meta
+}
+
+// applyMetadata gives the received file at path the sending end's metadata. The permissions
+// go last: writing extended attributes needs write permission, which the file may not keep.
+func applyMetadata(t *Transfer, path string, meta fileMetadata) {
+	for _, x := range meta.Xattrs {
+		if !xattrAllowed(x.Name) {
+			continue
+		}
+		if err := setXattr(path, x.Name, x.Value); err != nil {
+			t.warnOnce("write xattrs", "Could not save extended attributes, the destination folder may not support them: "+err.Error())
+		}
+	}
+	if !meta.ModTime.IsZero() {
+		if err := os.Chtimes(path, time.Now(), meta.ModTime); err != nil {
+			t.warnOnce("chtimes", "Could not set modification times: "+err.Error())
+		}
+	}
+	if err := os.Chmod(path, meta.Mode.Perm()); err != nil {
+		t.warnOnce("chmod", "Could not set file permissions, the destination folder may not support them: "+err.Error())
+	}
+}
+
+// warnOnce outputs msg the first time it's called with key in a session.
+func (t *Transfer) warnOnce(key, msg string) {
+	if t.warned == nil {
+		t.warned = map[string]bool{}
+	}
+	if !t.warned[key] {
+		t.warned[key] = true
+		t.output(msg)
+	}
+}
+
+// encodeMetadata is the part of the header after the mode and size: the modification time in
+// nanoseconds since 1970, then the extended attributes as a count and name-value pairs.
+func encodeMetadata(meta fileMetadata) []byte {
+	b := make([]byte, 10)
+	if !meta.ModTime.IsZero() {
+		binary.BigEndian.PutUint64(b, uint64(meta.ModTime.UnixNano()))
+	}
+	binary.BigEndian.PutUint16(b[8:], uint16(len(meta.Xattrs)))
+	for _, x := range meta.Xattrs {
+		b = append(b, byte(len(x.Name)))
+		b = append(b, x.Name...)
+		b = append(b, 0, 0, 0, 0)
+		binary.BigEndian.PutUint32(b[len(b)-4:], uint32(len(x.Value)))
+		b = append(b, x.Value...)
+	}
+	return b
+}
+
+// decodeMetadata reads metadata from the front of b and returns what's left after it.
+func decodeMetadata(b []byte, meta *fileMetadata) ([]byte, error) {
+	malformed := newTransferError(errTamperedChunk, "Received malformed file metadata.", nil)
+	if len(b) < 10 {
+		return nil, malformed
+	}
+	if nanos := int64(binary.BigEndian.Uint64(b)); nanos != 0 {
+		meta.ModTime = time.Unix(0, nanos)
+	}
+	count := int(binary.BigEndian.Uint16(b[8:]))
+	b = b[10:]
+	size := 0
+	for i := 0; i < count; i++ {
+		if len(b) < 1 || len(b) < 1+int(b[0])+4 {
+			return nil, malformed
+		}
+		name := string(b[1 : 1+b[0]])
+		b = b[1+len(name):]
+		valueLen := int(binary.BigEndian.Uint32(b))
+		b = b[4:]
+		size += len(name) + valueLen
+		if valueLen > len(b) || size > maxXattrBytes {
+			return nil, malformed
+		}
+		meta.Xattrs = append(meta.Xattrs, xattr{name, append([]byte(nil), b[:valueLen]...)})
+		b = b[valueLen:]
+	}
+	return b, nil
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestMetadata(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src", "script.sh")
+	data, err := writeRandomFile(src, CHUNKSIZE+1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// not every filesystem takes extended attributes. if this one doesn't, check the rest.
+	withXattr := setXattr(src, "user.flyingcarpet", []byte("test")) == nil
+	// read-only, so the receiving end has to write the attribute before the permissions
+	if err = os.Chmod(src, 0550); err != nil {
+		t.Fatal(err)
+	}
+	modTime := time.Date(2001, 2, 3, 4, 5, 6, 0, time.UTC)
+	if err = os.Chtimes(src, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+	dest := filepath.Join(dir, "dest")
+	if err = os.Mkdir(dest, 0755); err != nil {
+		t.Fatal(err)
+	}
+	p := newTestPair([]string{src}, dest)
+	p.sender.Xattrs, p.receiver.Xattrs = true, true
+	if err = checkBothSucceeded(p.run()); err != nil {
+		t.Fatal(err)
+	}
+	received := filepath.Join(dest, "script.sh")
+	if err = checkFile(received, data); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(received)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if runtime.GOOS != "windows" && info.Mode().Perm() != 0550 {
+		t.Fatalf("received file has permissions %v, want %v", info.Mode().Perm(), os.FileMode(0550))
+	}
+	if !info.ModTime().Equal(modTime) {
+		t.Fatalf("received file was modified %v, want %v", info.ModTime(), modTime)
+	}
+	if !withXattr {
+		return
+	}
+	xattrs, err := listXattrs(received)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, x := range xattrs {
+		if x.Name == "user.flyingcarpet" && string(x.Value) == "test" {
+			return
+		}
+	}
+	t.Fatal("received file is missing its extended attribute")
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// Multiplexing for two-way sessions. Both directions' transfers share the session's TCP
+// connection: everything written to one of the channels below goes over it in a segment
+// tagged with the channel's number, and a goroutine sorts what arrives into each channel's
+// queue. Each channel is a net.Conn, so the sending and receiving code runs on one unchanged.
+
+// channel, length
+const muxHeaderSize = 1 + 4
+
+// the most written in one segment, so neither direction holds the connection for long
+const maxMuxSegment = 256 * 1024
+
+// how many segments can wait on a channel before reading the connection waits for them to be read
+const muxQueueDepth = 64
+
+type muxSession struct {
+	conn      net.Conn
+	writeLock sync.Mutex
+	channels  []*muxChannel
+	done      chan struct{}
+	closeOnce sync.Once
+	err       error // why the connection stopped being read, once queue channels are closed
+}
+
+// newMuxSession starts sorting what arrives on conn into the given number of channels.
+func newMuxSession(conn net.Conn, channels int) *muxSession {
+	m := &muxSession{conn: conn, done: make(chan struct{})}
+	for i := 0; i < channels; i++ {
+		m.channels = append(m.channels, &muxChannel{session: m, id: byte(i), queue: make(chan []byte, muxQueueDepth), wake: make(chan struct{})})
+	}
+	go m.demux()
+	return m
+}
+
+func (m *muxSession) demux() {
+	defer func() {
+		for _, c := range m.channels {
+			close(c.queue)
+		}
+	}()
+	var header [muxHeaderSize]byte
+	for {
+		if _, err := io.ReadFull(m.conn, header[:]); err != nil {
+			m.err = err
+			return
+		}
+		length := binary.BigEndian.Uint32(header[1:])
+		if int(header[0]) >= len(m.channels) || length > maxMuxSegment {
+			m.err = newTransferError(errTamperedChunk, "Received data for a channel that doesn't exist.", nil)
+			return
+		}
+		segment := make([]byte, length)
+		if _, err := io.ReadFull(m.conn, segment); err != nil {
+			m.err = err
+			return
+		}
+		select {
+		case m.channels[header[0]].queue <- segment:
+		case <-m.done:
+			return
+		}
+	}
+}
+
+// close stops sorting incoming data. The connection itself is left to its owner.
+func (m *muxSession) close() {
+	m.closeOnce.Do(func() { close(m.done) })
+}
+
+// muxChannel is one channel of a muxSession.
+type muxChannel struct {
+	session *muxSession
+	id      byte
+	queue   chan []byte
+	pending []byte
+
+	lock     sync.Mutex
+	deadline time.Time
+	wake     chan struct{} // closed when the deadline changes
+}
+
+func (c *muxChannel) Read(b []byte) (int, error) {
+	for len(c.pending) == 0 {
+		if err := c.wait(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(b, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+// wait waits for the next segment, the deadline, or a change of deadline.
+func (c *muxChannel) wait() error {
+	c.lock.Lock()
+	deadline, wake := c.deadline, c.wake
+	c.lock.Unlock()
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		wait := time.Until(deadline)
+		if wait <= 0 {
+			return errMuxTimeout
+		}
+		timer := time.NewTimer(wait)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case segment, ok := <-c.queue:
+		if !ok {
+			if c.session.err != nil && c.session.err != io.EOF {
+				return c.session.err
+			}
+			return io.EOF
+		}
+		c.pending = segment
+	case <-timeout:
+		return errMuxTimeout
+	case <-wake:
+	case <-c.session.done:
+		return io.EOF
+	}
+	return nil
+}
+
+func (c *muxChannel) Write(b []byte) (int, error) {
+	written := 0
+	for len(b) > 0 {
+		n := len(b)
+		if n > maxMuxSegment {
+			n = maxMuxSegment
+		}
+		var header [muxHeaderSize]byte
+		header[0] = c.id
+		binary.BigEndian.PutUint32(header[1:], uint32(n))
+		c.session.writeLock.Lock()
+		buffers := net.Buffers{header[:], b[:n]}
+		_, err := buffers.WriteTo(c.session.conn)
+		c.session.writeLock.Unlock()
+		if err != nil {
+			return written, err
+		}
+		written += n
+		b = b[n:]
+	}
+	return written, nil
+}
+
+// Close does nothing: the channels end with the session.
+func (c *muxChannel) Close() error { return nil }
+
+func (c *muxChannel) LocalAddr() net.Addr  { return c.session.conn.LocalAddr() }
+func (c *muxChannel) RemoteAddr() net.Addr { return c.session.conn.RemoteAddr() }
+
+func (c *muxChannel) SetDeadline(t time.Time) error { return c.SetReadDeadline(t) }
+
+// SetReadDeadline makes reads give up at t, like a real connection's. Writes share the
+// session's connection, so they have no deadline of their own.
+func (c *muxChannel) SetReadDeadline(t time.Time) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.deadline = t
+	close(c.wake)
+	c.wake = make(chan struct{})
+	return nil
+}
+
+func (c *muxChannel) SetWriteDeadline(t time.Time) error { return nil }
+
+type muxTimeoutError struct{}
+
+func (muxTimeoutError) Error() string   { return "i/o timeout" }
+func (muxTimeoutError) Timeout() bool   { return true }
+func (muxTimeoutError) Temporary() bool { return true }
+
+var errMuxTimeout error = muxTimeoutError{}
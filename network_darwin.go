@@ -118,16 +118,6 @@ func connectToPeer(t *Transfer) (err error) {
 			return
 		}
 		go stayOnAdHoc(t)
-		if t.Peer == "mac" {
-			t.RecipientIP, err = findMac(t)
-			if err != nil {
-				return
-			}
-		} else if t.Peer == "windows" {
-			t.RecipientIP = findWindows(t)
-		} else if t.Peer == "linux" {
-			t.RecipientIP = findLinux(t)
-		}
 	} else if t.Mode == "receiving" {
 		if t.Peer == "windows" || t.Peer == "linux" {
 			if err = joinAdHoc(t); err != nil {
@@ -205,94 +195,6 @@ func getWifiInterface() string {
 	return runCommand(getInterfaceString)
 }
 
-func getIPAddress(t *Transfer) string {
-	var currentIP string
-	t.output("Waiting for local IP...")
-	for currentIP == "" {
-		currentIPString := "ipconfig getifaddr " + getWifiInterface()
-		currentIPBytes, err := exec.Command("sh", "-c", currentIPString).CombinedOutput()
-		if err != nil {
-			time.Sleep(time.Second * time.Duration(3))
-			continue
-		}
-		currentIP = strings.TrimSpace(string(currentIPBytes))
-	}
-	t.output(fmt.Sprintf("Wi-Fi interface IP found: %s", currentIP))
-	return currentIP
-}
-
-func findMac(t *Transfer) (peerIP string, err error) {
-	timeout := findMacTimeout
-	currentIP := getIPAddress(t)
-	pingString := "ping -c 5 169.254.255.255 | " + // ping broadcast address
-		"grep --line-buffered -oE '[0-9]{1,3}\\.[0-9]{1,3}\\.[0-9]{1,3}\\.[0-9]{1,3}' | " + // get all IPs
-		"grep --line-buffered -vE '169.254.255.255' | " + // exclude broadcast address
-		"grep -vE '" + currentIP + "'" // exclude current IP
-
-	t.output("Looking for peer IP for " + strconv.Itoa(findMacTimeout) + " seconds.")
-	for peerIP == "" {
-		select {
-		case <-t.Ctx.Done():
-			return "", errors.New("Exiting dialPeer, transfer was canceled.")
-		default:
-			if timeout <= 0 {
-				return "", errors.New("Could not find the peer computer within " + strconv.Itoa(findMacTimeout) + " seconds.")
-			}
-			pingBytes, pingErr := exec.Command("sh", "-c", pingString).CombinedOutput()
-			if pingErr != nil {
-				// t.output(fmt.Sprintf("Could not find peer. Waiting %2d more seconds. %s", timeout, pingErr))
-				timeout -= 2
-				time.Sleep(time.Second * time.Duration(2))
-				continue
-			}
-			peerIPs := string(pingBytes)
-			peerIP = peerIPs[:strings.Index(peerIPs, "\n")]
-		}
-	}
-	t.output(fmt.Sprintf("Peer IP found: %s", peerIP))
-	return
-}
-
-func findWindows(t *Transfer) (peerIP string) {
-	currentIP := getIPAddress(t)
-	if strings.Contains(currentIP, "192.168.137") {
-		return "192.168.137.1"
-	} else {
-		return "192.168.173.1"
-	}
-}
-
-func findLinux(t *Transfer) (peerIP string) {
-	// timeout := findMacTimeout
-	// currentIP := getIPAddress(t)
-	// pingString := "ping -b -c 5 $(ifconfig | awk '/" + getWifiInterface() + "/ {for(i=1; i<=3; i++) {getline;}; print $6}') 2>&1 | " + // ping broadcast address
-	// 	"grep --line-buffered -oE '[0-9]{1,3}\\.[0-9]{1,3}\\.[0-9]{1,3}\\.[0-9]{1,3}' | " + // get all IPs
-	// 	"grep --line-buffered -vE $(ifconfig | awk '/" + getWifiInterface() + "/ {for(i=1; i<=3; i++) {getline;}; print $6}') | " + // exclude broadcast address
-	// 	"grep -vE '" + currentIP + "'" // exclude current IP
-
-	// t.output("Looking for peer IP for " + strconv.Itoa(findMacTimeout) + " seconds.")
-	// for peerIP == "" {
-	// 	if timeout <= 0 {
-	// 		t.output("Could not find the peer computer within " + strconv.Itoa(findMacTimeout) + " seconds.")
-	// 		return "", false
-	// 	}
-	// 	pingBytes, pingErr := exec.Command("sh", "-c", pingString).CombinedOutput()
-	// 	if pingErr != nil {
-	// 		t.output(fmt.Sprintf("Could not find peer. Waiting %2d more seconds. %s", timeout, pingErr))
-	// 		t.output(fmt.Sprintf("peer IP: %s",string(pingBytes)))
-	// 		timeout -= 2
-	// 		time.Sleep(time.Second * time.Duration(2))
-	// 		continue
-	// 	}
-	// 	peerIPs := string(pingBytes)
-	// 	peerIP = peerIPs[:strings.Index(peerIPs, "\n")]
-	// }
-	// t.output(fmt.Sprintf("Peer IP found: %s", peerIP))
-	// success = true
-	// return
-	return "10.42.0.1"
-}
-
 func resetWifi(t *Transfer) {
 	wifiInterface := getWifiInterface()
 	cmdString := "networksetup -setairportpower " + wifiInterface + " off && networksetup -setairportpower " + wifiInterface + " on"
@@ -324,11 +226,18 @@ func stayOnAdHoc(t *Transfer) {
 }
 
 func runCommand(cmd string) (output string) {
-	cmdBytes, err := exec.Command("sh", "-c", cmd).CombinedOutput()
+	output, err := shellRunner{}.Run(cmd)
 	if err != nil {
 		return err.Error()
 	}
-	return strings.TrimSpace(string(cmdBytes))
+	return strings.TrimSpace(output)
+}
+
+type shellRunner struct{}
+
+func (shellRunner) Run(cmd string) (string, error) {
+	cmdBytes, err := exec.Command("sh", "-c", cmd).CombinedOutput()
+	return string(cmdBytes), err
 }
 
 func getCurrentUUID(t *Transfer) (uuid string) { return "" }
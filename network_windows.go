@@ -2,11 +2,9 @@ package main
 
 import (
 	"errors"
-	"fmt"
 	"os"
 	"os/exec"
 	"path/filepath"
-	"regexp"
 	"strconv"
 	"strings"
 	"syscall"
@@ -23,24 +21,21 @@ func connectToPeer(t *Transfer) (err error) {
 		}
 	} else if t.Mode == "sending" {
 		if t.Peer == "windows" {
-			if err = joinAdHoc(t); err != nil {
-				return
+			// the receiving end's discovery beacon has to get through. not fatal: joining
+			// doesn't otherwise need administrator rights.
+			if err := addDiscoveryFirewallRule(); err != nil {
+				t.output(err.Error())
 			}
-			t.RecipientIP, err = findPeer(t)
-			if err != nil {
+			if err = joinAdHoc(t); err != nil {
 				return
 			}
 		} else if t.Peer == "mac" || t.Peer == "linux" {
-			if err = addFirewallRule(t); err != nil {
+			if err = addDiscoveryFirewallRule(); err != nil {
 				return
 			}
 			if err = startAdHoc(t); err != nil {
 				return
 			}
-			t.RecipientIP, err = findPeer(t)
-			if err != nil {
-				return
-			}
 		}
 	}
 	return
@@ -177,57 +172,6 @@ func joinAdHoc(t *Transfer) (err error) {
 	return
 }
 
-func findPeer(t *Transfer) (string, error) {
-	ipPattern, _ := regexp.Compile("\\d{1,3}\\.\\d{1,3}\\.\\d{1,3}\\.\\d{1,3}")
-
-	// clear arp cache
-	runCommand("arp -d *")
-
-	// get ad hoc ip
-	var ifAddr string
-	for !ipPattern.Match([]byte(ifAddr)) {
-		ifString := "$(ipconfig | Select-String -Pattern '(?<ipaddr>192\\.168\\.(137|173)\\..*)').Matches.Groups[2].Value.Trim()"
-		ifCmd := exec.Command("powershell", "-c", ifString)
-		ifCmd.SysProcAttr = &syscall.SysProcAttr{HideWindow: true}
-		ifBytes, err := ifCmd.CombinedOutput()
-		if err != nil {
-			t.output("Error getting ad hoc IP, retrying.")
-		}
-		ifAddr = strings.TrimSpace(string(ifBytes))
-		time.Sleep(time.Second * time.Duration(2))
-	}
-
-	// necessary for wifi direct ip addresses
-	var thirdOctet string
-	if strings.Contains(ifAddr, "137") {
-		thirdOctet = "137"
-	} else {
-		thirdOctet = "173"
-	}
-
-	// run arp for that ip
-	var peerIP string
-	t.output("Looking for peer IP...")
-	for !ipPattern.Match([]byte(peerIP)) {
-		select {
-		case <-t.Ctx.Done():
-			return "", errors.New("Exiting joinAdHoc, transfer was canceled.")
-		default:
-			peerString := "$(arp -a -N " + ifAddr + " | Select-String -Pattern '(?<ip>192\\.168\\." + thirdOctet + "\\.\\d{1,3})' | Select-String -NotMatch '(?<nm>(" + ifAddr + "|192.168." + thirdOctet + ".255)\\s)').Matches.Value"
-			peerCmd := exec.Command("powershell", "-c", peerString)
-			peerCmd.SysProcAttr = &syscall.SysProcAttr{HideWindow: true}
-			peerBytes, err := peerCmd.CombinedOutput()
-			if err != nil {
-				t.output("Error getting peer IP, retrying.")
-			}
-			peerIP = strings.TrimSpace(string(peerBytes))
-			time.Sleep(time.Second * time.Duration(2))
-		}
-	}
-	t.output(fmt.Sprintf("Peer IP found: %s", peerIP))
-	return peerIP, nil
-}
-
 func getCurrentWifi(t *Transfer) (SSID string) {
 	cmdStr := "$(netsh wlan show interfaces | Select-String -Pattern 'Profile *: (?<profile>.*)').Matches.Groups[1].Value.Trim()"
 	cmd := exec.Command("powershell", "-c", cmdStr)
@@ -249,26 +193,42 @@ func resetWifi(t *Transfer) {
 		deleteFirewallRule(t)
 		stopAdHoc(t)
 	} else { // if Mode == "sending" && t.Peer == "windows"
+		deleteFirewallRule(t)
 		runCommand("netsh wlan delete profile name=" + t.SSID)
 		// rejoin previous wifi
 		t.output(runCommand("netsh wlan connect name=" + t.PreviousSSID))
 	}
 }
 
-func addFirewallRule(t *Transfer) (err error) {
+// addFirewallRule lets the sending end connect to the port the receiving end listens on.
+func addFirewallRule(t *Transfer) error {
+	if err := addInboundRule("localport="+strconv.Itoa(t.Port), "protocol=tcp"); err != nil {
+		return errors.New("Could not create firewall rule. You must run as administrator to receive. (Right-click \"Flying Carpet.exe\" and select \"Run as administrator.\") " + err.Error())
+	}
+	return nil
+}
+
+// addDiscoveryFirewallRule lets the receiving end's discovery beacon through to the sending end,
+// which doesn't listen for anything else.
+func addDiscoveryFirewallRule() error {
+	if err := addInboundRule("localport="+strconv.Itoa(discoveryPort), "protocol=udp"); err != nil {
+		return errors.New("Could not create firewall rule for finding the receiving end. Try running as administrator. (Right-click \"Flying Carpet.exe\" and select \"Run as administrator.\") " + err.Error())
+	}
+	return nil
+}
+
+// addInboundRule adds a rule allowing this program to receive on the given port. Rules are
+// named after the program, so deleteFirewallRule removes them all.
+func addInboundRule(rule ...string) error {
 	execPath, err := os.Executable()
 	if err != nil {
 		return errors.New("Failed to get executable path: " + err.Error())
 	}
-	cmd := exec.Command("netsh", "advfirewall", "firewall", "add", "rule", "name="+filepath.Base(execPath), "dir=in",
-		"action=allow", "program="+execPath, "enable=yes", "profile=any", "localport=3290", "protocol=tcp")
+	cmd := exec.Command("netsh", append([]string{"advfirewall", "firewall", "add", "rule", "name=" + filepath.Base(execPath), "dir=in",
+		"action=allow", "program=" + execPath, "enable=yes", "profile=any"}, rule...)...)
 	cmd.SysProcAttr = &syscall.SysProcAttr{HideWindow: true}
 	_, err = cmd.CombinedOutput()
-	if err != nil {
-		return errors.New("Could not create firewall rule. You must run as administrator to receive. (Right-click \"Flying Carpet.exe\" and select \"Run as administrator.\") " + err.Error())
-	}
-	// t.output("Firewall rule created.")
-	return
+	return err
 }
 
 func deleteFirewallRule(t *Transfer) {
@@ -286,22 +246,27 @@ func deleteFirewallRule(t *Transfer) {
 }
 
 func runCommand(cmdStr string) (output string) {
-	var cmdBytes []byte
-	err := errors.New("")
+	output, err := shellRunner{}.Run(cmdStr)
+	if err != nil {
+		return err.Error()
+	}
+	return strings.TrimSpace(output)
+}
+
+// shellRunner runs commands directly rather than through cmd.exe, without flashing a console window.
+type shellRunner struct{}
+
+func (shellRunner) Run(cmdStr string) (string, error) {
+	var cmd *exec.Cmd
 	cmdSlice := strings.Split(cmdStr, " ")
 	if len(cmdSlice) > 1 {
-		cmd := exec.Command(cmdSlice[0], cmdSlice[1:]...)
-		cmd.SysProcAttr = &syscall.SysProcAttr{HideWindow: true}
-		cmdBytes, err = cmd.CombinedOutput()
+		cmd = exec.Command(cmdSlice[0], cmdSlice[1:]...)
 	} else {
-		cmd := exec.Command(cmdStr)
-		cmd.SysProcAttr = &syscall.SysProcAttr{HideWindow: true}
-		cmdBytes, err = cmd.CombinedOutput()
+		cmd = exec.Command(cmdStr)
 	}
-	if err != nil {
-		return err.Error()
-	}
-	return strings.TrimSpace(string(cmdBytes))
+	cmd.SysProcAttr = &syscall.SysProcAttr{HideWindow: true}
+	cmdBytes, err := cmd.CombinedOutput()
+	return string(cmdBytes), err
 }
 
 func getCurrentUUID(t *Transfer) (uuid string) { return "" }
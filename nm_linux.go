@@ -0,0 +1,396 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/godbus/dbus/v5"
+	"strconv"
+	"time"
+)
+
+// A NetworkManager client, talking to it over the system D-Bus rather than parsing nmcli's
+// output. See https://developer.gnome.org/NetworkManager/stable/spec.html for the API.
+
+const nmDest = "org.freedesktop.NetworkManager"
+const nmPath = dbus.ObjectPath("/org/freedesktop/NetworkManager")
+const nmSettingsPath = dbus.ObjectPath("/org/freedesktop/NetworkManager/Settings")
+
+const nmDeviceTypeWifi = 2
+
+// NMActiveConnectionState
+const (
+	nmActivating   = 1
+	nmActivated    = 2
+	nmDeactivating = 3
+	nmDeactivated  = 4
+)
+
+// how long to wait for NetworkManager to bring a connection up
+const nmActivationTimeout = 15
+
+// nmSettings is a NetworkManager connection profile, the a{sa{sv}} its API passes around.
+type nmSettings map[string]map[string]dbus.Variant
+
+// dbusObject is the part of a D-Bus object the client uses, so tests can stand in for
+// NetworkManager without a bus.
+type dbusObject interface {
+	Call(method string, args []interface{}, results ...interface{}) error
+	Property(name string) (interface{}, error)
+}
+
+type networkManager struct {
+	object func(path dbus.ObjectPath) dbusObject
+}
+
+type busObject struct {
+	obj dbus.BusObject
+}
+
+func (o busObject) Call(method string, args []interface{}, results ...interface{}) error {
+	call := o.obj.Call(method, 0, args...)
+	if len(results) == 0 {
+		return call.Err
+	}
+	return call.Store(results...)
+}
+
+func (o busObject) Property(name string) (interface{}, error) {
+	v, err := o.obj.GetProperty(name)
+	if err != nil {
+		return nil, err
+	}
+	return v.Value(), nil
+}
+
+func (nm *networkManager) call(path dbus.ObjectPath, method string, args []interface{}, results ...interface{}) error {
+	if err := nm.object(path).Call(method, args, results...); err != nil {
+		return fmt.Errorf("NetworkManager %s failed: %s", method, err)
+	}
+	return nil
+}
+
+func (nm *networkManager) objectPath(path dbus.ObjectPath, name string) (dbus.ObjectPath, error) {
+	v, err := nm.object(path).Property(name)
+	if err != nil {
+		return "", err
+	}
+	p, ok := v.(dbus.ObjectPath)
+	if !ok {
+		return "", fmt.Errorf("NetworkManager property %s is not an object path", name)
+	}
+	return p, nil
+}
+
+func (nm *networkManager) stringProperty(path dbus.ObjectPath, name string) (string, error) {
+	v, err := nm.object(path).Property(name)
+	if err != nil {
+		return "", err
+	}
+	s, ok := v.(string)
+	if !ok {
+		return "", fmt.Errorf("NetworkManager property %s is not a string", name)
+	}
+	return s, nil
+}
+
+// wifiDevice finds the first wireless device NetworkManager manages.
+func (nm *networkManager) wifiDevice() (device dbus.ObjectPath, iface string, err error) {
+	var devices []dbus.ObjectPath
+	if err = nm.call(nmPath, nmDest+".GetDevices", nil, &devices); err != nil {
+		return
+	}
+	for _, d := range devices {
+		deviceType, err := nm.object(d).Property(nmDest + ".Device.DeviceType")
+		if err != nil || deviceType != uint32(nmDeviceTypeWifi) {
+			continue
+		}
+		iface, err = nm.stringProperty(d, nmDest+".Device.Interface")
+		if err != nil {
+			continue
+		}
+		return d, iface, nil
+	}
+	return "", "", errors.New("Could not find a WiFi device managed by NetworkManager.")
+}
+
+// activeConnection is the active connection on device, or "" if it's not connected.
+func (nm *networkManager) activeConnection(device dbus.ObjectPath) dbus.ObjectPath {
+	active, err := nm.objectPath(device, nmDest+".Device.ActiveConnection")
+	if err != nil || active == "/" {
+		return ""
+	}
+	return active
+}
+
+// addConnection adds a connection profile that lasts until NetworkManager restarts, so a
+// crash can't leave it in the user's saved networks.
+func (nm *networkManager) addConnection(settings nmSettings) (conn dbus.ObjectPath, err error) {
+	err = nm.call(nmSettingsPath, nmDest+".Settings.AddConnectionUnsaved", []interface{}{settings}, &conn)
+	return
+}
+
+func (nm *networkManager) activate(conn, device dbus.ObjectPath) (active dbus.ObjectPath, err error) {
+	err = nm.call(nmPath, nmDest+".ActivateConnection", []interface{}{conn, device, dbus.ObjectPath("/")}, &active)
+	return
+}
+
+// connectionsWithID lists the saved connection profiles with the given name.
+func (nm *networkManager) connectionsWithID(id string) (conns []dbus.ObjectPath, err error) {
+	var all []dbus.ObjectPath
+	if err = nm.call(nmSettingsPath, nmDest+".Settings.ListConnections", nil, &all); err != nil {
+		return
+	}
+	for _, conn := range all {
+		var settings nmSettings
+		if err := nm.call(conn, nmDest+".Settings.Connection.GetSettings", nil, &settings); err != nil {
+			continue
+		}
+		if v, ok := settings["connection"]["id"]; ok && v.Value() == id {
+			conns = append(conns, conn)
+		}
+	}
+	return
+}
+
+// deactivateID takes down any active connection with the given name.
+func (nm *networkManager) deactivateID(id string) error {
+	v, err := nm.object(nmPath).Property(nmDest + ".ActiveConnections")
+	if err != nil {
+		return err
+	}
+	actives, _ := v.([]dbus.ObjectPath)
+	for _, active := range actives {
+		if activeID, err := nm.stringProperty(active, nmDest+".Connection.Active.Id"); err == nil && activeID == id {
+			if err = nm.call(nmPath, nmDest+".DeactivateConnection", []interface{}{active}); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// deleteID removes the connection profiles with the given name.
+func (nm *networkManager) deleteID(id string) error {
+	conns, err := nm.connectionsWithID(id)
+	if err != nil {
+		return err
+	}
+	for _, conn := range conns {
+		if err = nm.call(conn, nmDest+".Settings.Connection.Delete", nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (nm *networkManager) activateUUID(uuid string, device dbus.ObjectPath) error {
+	var conn dbus.ObjectPath
+	if err := nm.call(nmSettingsPath, nmDest+".Settings.GetConnectionByUuid", []interface{}{uuid}, &conn); err != nil {
+		return err
+	}
+	_, err := nm.activate(conn, device)
+	return err
+}
+
+// ip4Address is device's first IPv4 address, or "" if it doesn't have one.
+func (nm *networkManager) ip4Address(device dbus.ObjectPath) string {
+	config, err := nm.objectPath(device, nmDest+".Device.Ip4Config")
+	if err != nil || config == "/" {
+		return ""
+	}
+	v, err := nm.object(config).Property(nmDest + ".IP4Config.AddressData")
+	if err != nil {
+		return ""
+	}
+	addresses, _ := v.([]map[string]dbus.Variant)
+	for _, a := range addresses {
+		if address, ok := a["address"].Value().(string); ok {
+			return address
+		}
+	}
+	return ""
+}
+
+// hotspotSettings is the profile for hosting the ad hoc network. NetworkManager runs a DHCP
+// server for "shared" connections, handing out 10.42.0.0/24 and taking 10.42.0.1 itself.
+func hotspotSettings(t *Transfer) nmSettings {
+	return nmSettings{
+		"connection": {
+			"id":          dbus.MakeVariant(t.SSID),
+			"type":        dbus.MakeVariant("802-11-wireless"),
+			"autoconnect": dbus.MakeVariant(false),
+		},
+		"802-11-wireless": {
+			"ssid": dbus.MakeVariant([]byte(t.SSID)),
+			"mode": dbus.MakeVariant("ap"),
+			"band": dbus.MakeVariant("bg"),
+		},
+		"802-11-wireless-security": {
+			"key-mgmt": dbus.MakeVariant("wpa-psk"),
+			"psk":      dbus.MakeVariant(t.Passphrase + t.Passphrase),
+		},
+		"ipv4": {"method": dbus.MakeVariant("shared")},
+		"ipv6": {"method": dbus.MakeVariant("ignore")},
+	}
+}
+
+// joinSettings is the profile for joining the peer's ad hoc network.
+func joinSettings(t *Transfer) nmSettings {
+	return nmSettings{
+		"connection": {
+			"id":          dbus.MakeVariant(t.SSID),
+			"type":        dbus.MakeVariant("802-11-wireless"),
+			"autoconnect": dbus.MakeVariant(false),
+		},
+		"802-11-wireless": {
+			"ssid": dbus.MakeVariant([]byte(t.SSID)),
+			"mode": dbus.MakeVariant("infrastructure"),
+		},
+		"802-11-wireless-security": {
+			"key-mgmt": dbus.MakeVariant("wpa-psk"),
+			"psk":      dbus.MakeVariant(t.Passphrase + t.Passphrase),
+		},
+		"ipv4": {"method": dbus.MakeVariant("auto")},
+		"ipv6": {"method": dbus.MakeVariant("ignore")},
+	}
+}
+
+// nmBackend sets up the ad hoc network with NetworkManager.
+type nmBackend struct {
+	hostTools
+	nm *networkManager
+}
+
+func (nmBackend) name() string { return "NetworkManager" }
+
+// waitForActivation waits for an active connection to finish coming up, and reports whether it did.
+func (b nmBackend) waitForActivation(t *Transfer, active dbus.ObjectPath) (bool, error) {
+	for i := 0; i < nmActivationTimeout; i++ {
+		select {
+		case <-t.Ctx.Done():
+			return false, errors.New("Transfer was canceled.")
+		default:
+		}
+		state, err := b.nm.object(active).Property(nmDest + ".Connection.Active.State")
+		if err != nil {
+			// NetworkManager removes active connections that fail
+			return false, nil
+		}
+		switch state {
+		case uint32(nmActivated):
+			return true, nil
+		case uint32(nmDeactivating), uint32(nmDeactivated):
+			return false, nil
+		}
+		b.sleep(time.Second)
+	}
+	return false, nil
+}
+
+func (b nmBackend) startAdHoc(t *Transfer) (err error) {
+	device, _, err := b.nm.wifiDevice()
+	if err != nil {
+		return
+	}
+	conn, err := b.nm.addConnection(hotspotSettings(t))
+	if err != nil {
+		return
+	}
+	active, err := b.nm.activate(conn, device)
+	if err != nil {
+		return
+	}
+	up, err := b.waitForActivation(t, active)
+	if err != nil {
+		return
+	}
+	if !up {
+		return errors.New("Could not start ad hoc network " + t.SSID + ". Does your WiFi card support access point mode?")
+	}
+	t.output("Started ad hoc network " + t.SSID + ".")
+	return
+}
+
+func (b nmBackend) joinAdHoc(t *Transfer) (err error) {
+	timeout := joinAdHocTimeout
+	device, _, err := b.nm.wifiDevice()
+	if err != nil {
+		return
+	}
+	conn, err := b.nm.addConnection(joinSettings(t))
+	if err != nil {
+		return
+	}
+	for {
+		select {
+		case <-t.Ctx.Done():
+			return errors.New("Exiting joinAdHoc, transfer was canceled.")
+		default:
+		}
+		active, err := b.nm.activate(conn, device)
+		if err == nil {
+			var up bool
+			if up, err = b.waitForActivation(t, active); up {
+				t.output("Joined ad hoc network " + t.SSID + ".")
+				return nil
+			}
+		}
+		if err != nil {
+			t.output(fmt.Sprintf("Error joining ad hoc network: %s", err))
+		}
+		if timeout <= 0 {
+			return errors.New("Could not find the ad hoc network within " + strconv.Itoa(joinAdHocTimeout) + " seconds.")
+		}
+		timeout -= 5
+		b.sleep(time.Second * time.Duration(5))
+	}
+}
+
+func (b nmBackend) resetWifi(t *Transfer) {
+	if err := b.nm.deactivateID(t.SSID); err != nil {
+		t.output("Error stopping ad hoc network: " + err.Error())
+	}
+	if err := b.nm.deleteID(t.SSID); err != nil {
+		t.output("Error removing ad hoc network: " + err.Error())
+	}
+	if t.PreviousSSID == "" {
+		return
+	}
+	device, _, err := b.nm.wifiDevice()
+	if err == nil {
+		err = b.nm.activateUUID(t.PreviousSSID, device)
+	}
+	if err != nil {
+		t.output("Error rejoining previous network: " + err.Error())
+	}
+}
+
+// activeProperty reads a property of the WiFi card's active connection.
+func (b nmBackend) activeProperty(name string) (value string) {
+	device, _, err := b.nm.wifiDevice()
+	if err != nil {
+		return
+	}
+	if active := b.nm.activeConnection(device); active != "" {
+		value, _ = b.nm.stringProperty(active, nmDest+".Connection.Active."+name)
+	}
+	return
+}
+
+// the connection's UUID, which is what it's reactivated by
+func (b nmBackend) currentConnection() string { return b.activeProperty("Uuid") }
+
+func (b nmBackend) currentSSID() string { return b.activeProperty("Id") }
+
+func (b nmBackend) wifiInterface() (iface string) {
+	_, iface, _ = b.nm.wifiDevice()
+	return
+}
+
+func (b nmBackend) ipAddress() string {
+	device, _, err := b.nm.wifiDevice()
+	if err != nil {
+		return ""
+	}
+	return b.nm.ip4Address(device)
+}
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/godbus/dbus/v5"
+	"strings"
+	"testing"
+	"time"
+)
+
+const fakeWifiDevice = dbus.ObjectPath("/org/freedesktop/NetworkManager/Devices/2")
+
+const fakeHomeConnection = dbus.ObjectPath("/org/freedesktop/NetworkManager/Settings/1")
+
+// fakeNetworkManager answers the D-Bus calls the client makes the way NetworkManager would,
+// for a computer with an Ethernet port and a WiFi card connected to a network called Home.
+type fakeNetworkManager struct {
+	fakeBus
+	// how many activations of joined networks fail before one works, or -1 for all of them
+	failJoins int
+
+	added       []nmSettings
+	activated   []dbus.ObjectPath
+	deactivated []dbus.ObjectPath
+	deleted     []dbus.ObjectPath
+}
+
+func newFakeNetworkManager() *fakeNetworkManager {
+	f := &fakeNetworkManager{fakeBus: fakeBus{objects: map[dbus.ObjectPath]*fakeDBusObject{}}}
+	homeActive := dbus.ObjectPath("/org/freedesktop/NetworkManager/ActiveConnection/1")
+	ip4Config := dbus.ObjectPath("/org/freedesktop/NetworkManager/IP4Config/1")
+
+	f.objects[nmPath] = &fakeDBusObject{
+		props: map[string]interface{}{nmDest + ".ActiveConnections": []dbus.ObjectPath{homeActive}},
+		methods: map[string]func([]interface{}) ([]interface{}, error){
+			nmDest + ".GetDevices": func([]interface{}) ([]interface{}, error) {
+				return []interface{}{[]dbus.ObjectPath{"/org/freedesktop/NetworkManager/Devices/1", fakeWifiDevice}}, nil
+			},
+			nmDest + ".ActivateConnection":   f.activateConnection,
+			nmDest + ".DeactivateConnection": f.deactivateConnection,
+		},
+	}
+	f.objects[nmSettingsPath] = &fakeDBusObject{
+		methods: map[string]func([]interface{}) ([]interface{}, error){
+			nmDest + ".Settings.AddConnectionUnsaved": f.addConnectionUnsaved,
+			nmDest + ".Settings.ListConnections":      f.listConnections,
+			nmDest + ".Settings.GetConnectionByUuid":  f.getConnectionByUUID,
+		},
+	}
+	f.objects["/org/freedesktop/NetworkManager/Devices/1"] = &fakeDBusObject{props: map[string]interface{}{
+		nmDest + ".Device.DeviceType": uint32(1),
+		nmDest + ".Device.Interface":  "eth0",
+	}}
+	f.objects[fakeWifiDevice] = &fakeDBusObject{props: map[string]interface{}{
+		nmDest + ".Device.DeviceType":       uint32(nmDeviceTypeWifi),
+		nmDest + ".Device.Interface":        "wlan0",
+		nmDest + ".Device.ActiveConnection": homeActive,
+		nmDest + ".Device.Ip4Config":        ip4Config,
+	}}
+	f.objects[ip4Config] = &fakeDBusObject{props: map[string]interface{}{
+		nmDest + ".IP4Config.AddressData": []map[string]dbus.Variant{
+			{"address": dbus.MakeVariant("192.168.1.20"), "prefix": dbus.MakeVariant(uint32(24))},
+		},
+	}}
+	f.addSettings(fakeHomeConnection, nmSettings{"connection": {
+		"id":   dbus.MakeVariant("Home"),
+		"uuid": dbus.MakeVariant("home-uuid"),
+	}})
+	f.objects[homeActive] = &fakeDBusObject{props: map[string]interface{}{
+		nmDest + ".Connection.Active.Id":    "Home",
+		nmDest + ".Connection.Active.Uuid":  "home-uuid",
+		nmDest + ".Connection.Active.State": uint32(nmActivated),
+	}}
+	return f
+}
+
+// backend is an nmBackend that talks to f and waits on f's clock.
+func (f *fakeNetworkManager) backend() nmBackend {
+	return nmBackend{hostTools{sleep: f.sleep}, &networkManager{object: f.object}}
+}
+
+func (f *fakeNetworkManager) newPath(kind string) dbus.ObjectPath {
+	f.nextID++
+	return dbus.ObjectPath(fmt.Sprintf("/org/freedesktop/NetworkManager/%s/%d", kind, 100+f.nextID))
+}
+
+func (f *fakeNetworkManager) addSettings(path dbus.ObjectPath, settings nmSettings) {
+	f.objects[path] = &fakeDBusObject{
+		props: map[string]interface{}{},
+		methods: map[string]func([]interface{}) ([]interface{}, error){
+			nmDest + ".Settings.Connection.GetSettings": func([]interface{}) ([]interface{}, error) {
+				return []interface{}{settings}, nil
+			},
+			nmDest + ".Settings.Connection.Delete": func([]interface{}) ([]interface{}, error) {
+				f.lock.Lock()
+				defer f.lock.Unlock()
+				delete(f.objects, path)
+				f.deleted = append(f.deleted, path)
+				return nil, nil
+			},
+		},
+	}
+}
+
+func (f *fakeNetworkManager) addConnectionUnsaved(args []interface{}) ([]interface{}, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	settings := args[0].(nmSettings)
+	f.added = append(f.added, settings)
+	path := f.newPath("Settings")
+	f.addSettings(path, settings)
+	return []interface{}{path}, nil
+}
+
+func (f *fakeNetworkManager) listConnections([]interface{}) ([]interface{}, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	var conns []dbus.ObjectPath
+	for path := range f.objects {
+		if strings.HasPrefix(string(path), "/org/freedesktop/NetworkManager/Settings/") {
+			conns = append(conns, path)
+		}
+	}
+	return []interface{}{conns}, nil
+}
+
+func (f *fakeNetworkManager) getConnectionByUUID(args []interface{}) ([]interface{}, error) {
+	if args[0] != "home-uuid" {
+		return nil, errors.New("no connection with that UUID")
+	}
+	return []interface{}{fakeHomeConnection}, nil
+}
+
+// activateConnection brings up a connection on the WiFi card. Like NetworkManager, it
+// accepts a network that isn't there and then fails to activate it.
+func (f *fakeNetworkManager) activateConnection(args []interface{}) ([]interface{}, error) {
+	conn, device := args[0].(dbus.ObjectPath), args[1].(dbus.ObjectPath)
+	if device != fakeWifiDevice {
+		return nil, errors.New("wrong device")
+	}
+	settings, err := f.object(conn).(fakeBusObject).settings()
+	if err != nil {
+		return nil, err
+	}
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.activated = append(f.activated, conn)
+	state := uint32(nmActivated)
+	if mode, ok := settings["802-11-wireless"]["mode"]; ok && mode.Value() == "infrastructure" && f.failJoins != 0 {
+		state = nmDeactivated
+		if f.failJoins > 0 {
+			f.failJoins--
+		}
+	}
+	id, _ := settings["connection"]["id"].Value().(string)
+	active := f.newPath("ActiveConnection")
+	f.objects[active] = &fakeDBusObject{props: map[string]interface{}{
+		nmDest + ".Connection.Active.Id":    id,
+		nmDest + ".Connection.Active.State": state,
+	}}
+	if state == nmActivated {
+		f.objects[fakeWifiDevice].props[nmDest+".Device.ActiveConnection"] = active
+		f.objects[nmPath].props[nmDest+".ActiveConnections"] = []dbus.ObjectPath{active}
+	}
+	return []interface{}{active}, nil
+}
+
+func (f *fakeNetworkManager) deactivateConnection(args []interface{}) ([]interface{}, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	active := args[0].(dbus.ObjectPath)
+	f.deactivated = append(f.deactivated, active)
+	f.objects[active].props[nmDest+".Connection.Active.State"] = uint32(nmDeactivated)
+	f.objects[fakeWifiDevice].props[nmDest+".Device.ActiveConnection"] = dbus.ObjectPath("/")
+	f.objects[nmPath].props[nmDest+".ActiveConnections"] = []dbus.ObjectPath{}
+	return nil, nil
+}
+
+func (o fakeBusObject) settings() (settings nmSettings, err error) {
+	err = o.Call(nmDest+".Settings.Connection.GetSettings", nil, &settings)
+	return
+}
+
+func TestNMDevice(t *testing.T) {
+	b := newFakeNetworkManager().backend()
+	if iface := b.wifiInterface(); iface != "wlan0" {
+		t.Fatalf("expected WiFi interface wlan0, got %q", iface)
+	}
+	if ip := b.ipAddress(); ip != "192.168.1.20" {
+		t.Fatalf("expected address 192.168.1.20, got %q", ip)
+	}
+	if uuid := b.currentConnection(); uuid != "home-uuid" {
+		t.Fatalf("expected current connection home-uuid, got %q", uuid)
+	}
+}
+
+func TestStartAdHoc(t *testing.T) {
+	f := newFakeNetworkManager()
+	b := f.backend()
+	tr, _ := newNetworkTestTransfer("receiving", "linux")
+	// profiles are built over D-Bus, so SSIDs with spaces need no quoting
+	tr.SSID = "flyingCarpet self test"
+	if err := b.startAdHoc(tr); err != nil {
+		t.Fatal(err)
+	}
+	if len(f.added) != 1 || len(f.activated) != 1 {
+		t.Fatalf("expected one connection added and activated, got %d and %d", len(f.added), len(f.activated))
+	}
+	s := f.added[0]
+	ssid, _ := s["802-11-wireless"]["ssid"].Value().([]byte)
+	switch {
+	case !bytes.Equal(ssid, []byte("flyingCarpet self test")):
+		t.Fatalf("wrong SSID %q", ssid)
+	case s["802-11-wireless"]["mode"].Value() != "ap":
+		t.Fatal("network is not in access point mode")
+	case s["802-11-wireless-security"]["psk"].Value() != "testtest":
+		t.Fatal("wrong network password")
+	case s["ipv4"]["method"].Value() != "shared":
+		t.Fatal("network doesn't hand out addresses")
+	}
+}
+
+func TestJoinAdHocRetries(t *testing.T) {
+	f := newFakeNetworkManager()
+	f.failJoins = 3
+	b := f.backend()
+	tr, _ := newNetworkTestTransfer("sending", "linux")
+	if err := b.joinAdHoc(tr); err != nil {
+		t.Fatal(err)
+	}
+	if len(f.activated) != 4 {
+		t.Fatalf("expected 4 attempts to join, got %d", len(f.activated))
+	}
+	if f.slept != 15*time.Second {
+		t.Fatalf("expected to wait 15s between attempts, waited %s", f.slept)
+	}
+}
+
+func TestJoinAdHocTimeout(t *testing.T) {
+	f := newFakeNetworkManager()
+	f.failJoins = -1
+	b := f.backend()
+	tr, _ := newNetworkTestTransfer("sending", "linux")
+	err := b.joinAdHoc(tr)
+	if err == nil || !strings.Contains(err.Error(), "Could not find the ad hoc network") {
+		t.Fatalf("expected to give up on the network, got: %v", err)
+	}
+	if f.slept != time.Duration(joinAdHocTimeout)*time.Second {
+		t.Fatalf("expected to keep trying for %ds, waited %s", joinAdHocTimeout, f.slept)
+	}
+}
+
+func TestJoinAdHocCanceled(t *testing.T) {
+	f := newFakeNetworkManager()
+	f.failJoins = -1
+	b := f.backend()
+	tr, _ := newNetworkTestTransfer("sending", "linux")
+	tr.CancelCtx()
+	err := b.joinAdHoc(tr)
+	if err == nil || !strings.Contains(err.Error(), "canceled") {
+		t.Fatalf("expected cancellation, got: %v", err)
+	}
+	if f.slept != 0 {
+		t.Fatalf("kept retrying after cancellation, waited %s", f.slept)
+	}
+}
+
+func TestResetWifi(t *testing.T) {
+	f := newFakeNetworkManager()
+	b := f.backend()
+	tr, _ := newNetworkTestTransfer("receiving", "mac")
+	tr.PreviousSSID = b.currentConnection()
+	if err := b.startAdHoc(tr); err != nil {
+		t.Fatal(err)
+	}
+	hotspot := f.activated[0]
+	b.resetWifi(tr)
+	if len(f.deactivated) != 1 {
+		t.Fatalf("expected the ad hoc network to be stopped, deactivated %q", f.deactivated)
+	}
+	if len(f.deleted) != 1 || f.deleted[0] != hotspot {
+		t.Fatalf("expected the ad hoc network's profile to be removed, deleted %q", f.deleted)
+	}
+	if last := f.activated[len(f.activated)-1]; last != fakeHomeConnection {
+		t.Fatalf("expected to rejoin Home, last activated %s", last)
+	}
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"errors"
+	"fmt"
+	"github.com/gtank/ristretto255"
+	"io"
+	"net"
+)
+
+// Password-authenticated key exchange (CPace over ristretto255). Both ends turn the
+// transfer password into a group generator, trade one ephemeral public value each, and
+// derive the session key from the shared secret. An eavesdropper only ever sees random
+// group elements, so there's nothing to brute-force offline, and someone who guesses the
+// password online gets one try per connection. The protocol preambles are part of the
+// transcript, so features can't be stripped from them in transit without failing the exchange.
+
+const pakeDSI = "FlyingCarpet-CPace-ristretto255"
+const elementSize = 32
+const confirmSize = sha256.Size
+
+var errWrongPassword = newTransferError(errBadPassword, "Wrong password, or the connection was tampered with. Make sure you entered the password shown on the receiving end.", nil)
+
+// initiateKeyExchange is run by the sending end once the protocol has been negotiated.
+func initiateKeyExchange(pConn *net.Conn, t *Transfer) (err error) {
+	conn := *pConn
+	defer readDeadline(t.Ctx, conn, handshakeTimeout)()
+	defer func() { err = t.canceled(err, "initiateKeyExchange") }()
+
+	salt := generateSalt()
+	generator := pakeGenerator(t.Passphrase, salt)
+	secret := randomScalar()
+	ourElement := ristretto255.NewElement().ScalarMult(secret, generator).Encode(nil)
+
+	if err = writeFrame(conn, frameKeyExchange, append(salt, ourElement...)); err != nil {
+		return streamError("Error sending key exchange:", err)
+	}
+
+	reply, err := expectFrame(conn, frameKeyExchange, "key exchange")
+	if err != nil {
+		return err
+	}
+	if len(reply) != elementSize+confirmSize {
+		return newTransferError(errTamperedChunk, "Received malformed key exchange from peer.", nil)
+	}
+	peerElement, peerConfirm := reply[:elementSize], reply[elementSize:]
+
+	sessionKey, receiverConfirm, senderConfirm, err := pakeFinish(secret, peerElement, salt, t.preambles, ourElement, peerElement)
+	if err != nil {
+		return err
+	}
+	if !hmac.Equal(peerConfirm, receiverConfirm) {
+		return errWrongPassword
+	}
+	if err = writeFrame(conn, frameKeyExchange, senderConfirm); err != nil {
+		return streamError("Error sending key confirmation:", err)
+	}
+	t.Key = sessionKey
+	return nil
+}
+
+// respondKeyExchange is run by the receiving end once the protocol has been negotiated.
+func respondKeyExchange(pConn *net.Conn, t *Transfer) (err error) {
+	conn := *pConn
+	defer readDeadline(t.Ctx, conn, handshakeTimeout)()
+	defer func() { err = t.canceled(err, "respondKeyExchange") }()
+
+	hello, err := expectFrame(conn, frameKeyExchange, "key exchange")
+	if err != nil {
+		return err
+	}
+	if len(hello) != saltSize+elementSize {
+		return newTransferError(errTamperedChunk, "Received malformed key exchange from peer.", nil)
+	}
+	salt, peerElement := hello[:saltSize], hello[saltSize:]
+
+	generator := pakeGenerator(t.Passphrase, salt)
+	secret := randomScalar()
+	ourElement := ristretto255.NewElement().ScalarMult(secret, generator).Encode(nil)
+
+	sessionKey, receiverConfirm, senderConfirm, err := pakeFinish(secret, peerElement, salt, t.preambles, peerElement, ourElement)
+	if err != nil {
+		return err
+	}
+	if err = writeFrame(conn, frameKeyExchange, append(ourElement, receiverConfirm...)); err != nil {
+		return streamError("Error sending key exchange:", err)
+	}
+
+	// the sending end hangs up without confirming if our confirmation didn't match theirs.
+	// anything else that goes wrong here is a problem with the connection.
+	ft, peerConfirm, err := readFrame(conn)
+	if err == io.EOF {
+		return newTransferError(errBadPassword, "Sending end closed the connection during key exchange. The password entered there was probably wrong.", nil)
+	}
+	if err != nil {
+		if _, ok := err.(*transferError); ok {
+			return err
+		}
+		return streamError("Error receiving key confirmation:", err)
+	}
+	if ft != frameKeyExchange {
+		return newTransferError(errTamperedChunk, fmt.Sprintf("Expected key confirmation from peer but received frame type %d.", ft), nil)
+	}
+	if !hmac.Equal(peerConfirm, senderConfirm) {
+		return errWrongPassword
+	}
+	t.Key = sessionKey
+	return nil
+}
+
+// pakeGenerator hashes the stretched password and the per-transfer salt onto the group.
+func pakeGenerator(passphrase string, salt []byte) *ristretto255.Element {
+	h := sha512.New()
+	h.Write([]byte(pakeDSI))
+	h.Write(deriveKey(passphrase, salt)[:])
+	h.Write(salt)
+	return ristretto255.NewElement().FromUniformBytes(h.Sum(nil))
+}
+
+// pakeFinish computes the shared secret and derives the session key and both ends' key
+// confirmation values from it and the transcript: the salt, the preambles as this end saw
+// them, and both ends' public values.
+func pakeFinish(secret *ristretto255.Scalar, peerEncoded, salt, preambles, senderElement, receiverElement []byte) (key *[32]byte, receiverConfirm, senderConfirm []byte, err error) {
+	peerElement := ristretto255.NewElement()
+	if err = peerElement.Decode(peerEncoded); err != nil {
+		return nil, nil, nil, errors.New("Received invalid key exchange value from peer.")
+	}
+	if peerElement.Equal(ristretto255.NewElement().Zero()) == 1 {
+		return nil, nil, nil, errors.New("Received invalid key exchange value from peer.")
+	}
+	shared := ristretto255.NewElement().ScalarMult(secret, peerElement).Encode(nil)
+
+	h := sha512.New()
+	h.Write([]byte(pakeDSI))
+	h.Write(shared)
+	h.Write(salt)
+	h.Write(preambles)
+	h.Write(senderElement)
+	h.Write(receiverElement)
+	isk := h.Sum(nil)
+
+	key = new([32]byte)
+	copy(key[:], isk[:32])
+	receiverConfirm = confirmTag(isk[32:], "receiver")
+	senderConfirm = confirmTag(isk[32:], "sender")
+	return
+}
+
+func confirmTag(macKey []byte, role string) []byte {
+	mac := hmac.New(sha256.New, macKey)
+	mac.Write([]byte(role))
+	return mac.Sum(nil)
+}
+
+func randomScalar() *ristretto255.Scalar {
+	b := make([]byte, 64)
+	if _, err := io.ReadFull(rand.Reader, b); err != nil {
+		panic(err)
+	}
+	return ristretto255.NewScalar().FromUniformBytes(b)
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+// A fileEntry is one file or directory to send. RelPath is where it goes relative to the
+// receiving end's destination folder, always with forward slashes.
+type fileEntry struct {
+	Path    string
+	RelPath string
+	IsDir   bool
+}
+
+// expandFileList turns the files and folders the user picked into the list of entries to
+// send, walking folders so their whole tree (including empty directories) comes along.
+func expandFileList(t *Transfer) (entries []fileEntry, err error) {
+	for _, selected := range t.FileList {
+		selected = filepath.Clean(selected)
+		info, err := os.Stat(selected)
+		if err != nil {
+			return nil, newTransferError(errLocalIO, "Could not find "+selected+":", err)
+		}
+		if !info.IsDir() {
+			entries = append(entries, fileEntry{Path: selected, RelPath: filepath.Base(selected)})
+			continue
+		}
+		parent := filepath.Dir(selected)
+		err = filepath.Walk(selected, func(p string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if info.Mode()&os.ModeSymlink != 0 {
+				t.output("Skipping symbolic link " + p)
+				return nil
+			}
+			if !info.IsDir() && !info.Mode().IsRegular() {
+				t.output("Skipping special file " + p)
+				return nil
+			}
+			rel, err := filepath.Rel(parent, p)
+			if err != nil {
+				return err
+			}
+			entries = append(entries, fileEntry{Path: p, RelPath: filepath.ToSlash(rel), IsDir: info.IsDir()})
+			return nil
+		})
+		if err != nil {
+			return nil, newTransferError(errLocalIO, "Error reading folder "+selected+":", err)
+		}
+	}
+	return
+}
+
+// safeJoin returns where the entry with the given relative path belongs under root, refusing
+// anything that would land outside it: absolute paths, "..", and symlinks pointing elsewhere.
+func safeJoin(root, relPath string) (string, error) {
+	bad := fmt.Sprintf("Peer sent unsafe path %q, refusing to write it.", relPath)
+	if relPath == "" || strings.HasPrefix(relPath, "/") || strings.Contains(relPath, "\\") || strings.ContainsRune(relPath, 0) {
+		return "", newTransferError(errTamperedChunk, bad, nil)
+	}
+	if path.Clean(relPath) != relPath {
+		return "", newTransferError(errTamperedChunk, bad, nil)
+	}
+	parts := strings.Split(relPath, "/")
+	for _, part := range parts {
+		if part == "." || part == ".." || filepath.VolumeName(part) != "" {
+			return "", newTransferError(errTamperedChunk, bad, nil)
+		}
+		// no drive letters or alternate data streams
+		if runtime.GOOS == "windows" && strings.Contains(part, ":") {
+			return "", newTransferError(errTamperedChunk, bad, nil)
+		}
+	}
+
+	realRoot, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return "", newTransferError(errLocalIO, "Error accessing destination folder:", err)
+	}
+	// check every existing component on the way down, including the last
+	current := root
+	for _, part := range parts {
+		current = filepath.Join(current, part)
+		info, err := os.Lstat(current)
+		if err != nil {
+			break // doesn't exist yet, so nothing below it can either
+		}
+		if info.Mode()&os.ModeSymlink == 0 {
+			continue
+		}
+		target, err := filepath.EvalSymlinks(current)
+		if err != nil || !isWithin(realRoot, target) {
+			return "", newTransferError(errTamperedChunk, bad, errors.New("Symbolic link leads outside destination folder."))
+		}
+	}
+	return filepath.Join(root, filepath.FromSlash(relPath)), nil
+}
+
+func isWithin(root, p string) bool {
+	rel, err := filepath.Rel(root, p)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(os.PathSeparator))
+}
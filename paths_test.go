@@ -0,0 +1,143 @@
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSafeJoin(t *testing.T) {
+	root := t.TempDir()
+	for _, c := range []struct {
+		relPath string
+		ok      bool
+	}{
+		{"a.bin", true},
+		{"sub/a.bin", true},
+		{"sub/deeper/a.bin", true},
+		{"", false},
+		{"..", false},
+		{"../a.bin", false},
+		{"sub/../../a.bin", false},
+		{"sub/../a.bin", false},
+		{"/a.bin", false},
+		{"/etc/passwd", false},
+		{"..\\a.bin", false},
+		{"sub\\a.bin", false},
+		{".", false},
+		{"./a.bin", false},
+		{"sub/./a.bin", false},
+		{"sub/", false},
+		{"sub//a.bin", false},
+		{"a\x00.bin", false},
+	} {
+		got, err := safeJoin(root, c.relPath)
+		if !c.ok {
+			if !isErrorKind(err, errTamperedChunk) {
+				t.Errorf("%q should have been refused, got %q, %v", c.relPath, got, err)
+			}
+			continue
+		}
+		if want := filepath.Join(root, filepath.FromSlash(c.relPath)); err != nil || got != want {
+			t.Errorf("%q should have been %q, got %q, %v", c.relPath, want, got, err)
+		}
+	}
+}
+
+func TestSafeJoinSymlinks(t *testing.T) {
+	dir := t.TempDir()
+	root := filepath.Join(dir, "dest")
+	outside := filepath.Join(dir, "outside")
+	for _, d := range []string{filepath.Join(root, "sub"), outside} {
+		if err := os.MkdirAll(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink(outside, filepath.Join(root, "away")); err != nil {
+		t.Skip("can't make symbolic links here:", err)
+	}
+	if err := os.Symlink(filepath.Join(root, "sub"), filepath.Join(root, "inside")); err != nil {
+		t.Fatal(err)
+	}
+	for _, relPath := range []string{"away", "away/a.bin", "away/deeper/a.bin"} {
+		if _, err := safeJoin(root, relPath); !isErrorKind(err, errTamperedChunk) {
+			t.Errorf("%q leads outside the destination and should have been refused, got: %v", relPath, err)
+		}
+	}
+	if _, err := safeJoin(root, "inside/a.bin"); err != nil {
+		t.Errorf("a link that stays inside the destination should be allowed, got: %v", err)
+	}
+}
+
+// craftedSender is a sending end that offers src under relPath, whatever it's really called,
+// supporting only caps.
+func craftedSender(src, relPath string, caps uint32) func(*net.Conn, *Transfer) error {
+	return func(pConn *net.Conn, t *Transfer) error {
+		ours, err := writePreamble(*pConn, caps)
+		if err != nil {
+			return err
+		}
+		theirs, _, peerCaps, err := readPreamble(*pConn)
+		if err != nil {
+			return err
+		}
+		t.preambles, t.Capabilities = append(ours, theirs...), peerCaps&caps
+		if err = initiateKeyExchange(pConn, t); err != nil {
+			return err
+		}
+		*pConn = newSealedConn(*pConn, t.Key, sealSession, true)
+		if err = openStreams(pConn, t); err != nil {
+			return err
+		}
+		t.Entries = []fileEntry{{Path: src, RelPath: relPath}}
+		if err = sendCount(pConn, t); err != nil {
+			return err
+		}
+		if t.hasCapability(capManifest) {
+			if _, err = offerEntries(*pConn, t); err != nil {
+				return err
+			}
+		}
+		t.Filepath, t.RelPath = src, relPath
+		return chunkAndSend(pConn, t)
+	}
+}
+
+func TestUnsafePathRefused(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src", "file.bin")
+	if _, err := writeRandomFile(src, 1000); err != nil {
+		t.Fatal(err)
+	}
+	dest := filepath.Join(dir, "dest")
+	outside := filepath.Join(dir, "outside")
+	for _, d := range []string{dest, outside} {
+		if err := os.Mkdir(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	relPaths := []string{"../escaped.bin", "sub/../../escaped.bin", filepath.ToSlash(filepath.Join(dir, "escaped.bin"))}
+	if err := os.Symlink(outside, filepath.Join(dest, "away")); err == nil {
+		relPaths = append(relPaths, "away/escaped.bin")
+	}
+	// refused from the manifest, and from the file's header when there isn't one
+	for _, caps := range []uint32{ourCapabilities, ourCapabilities &^ capManifest} {
+		for _, relPath := range relPaths {
+			p := newTestPair(nil, dest)
+			p.send = craftedSender(src, relPath, caps)
+			_, recvErr := p.run()
+			if !isErrorKind(recvErr, errTamperedChunk) {
+				t.Errorf("%q should have been refused, got: %v", relPath, recvErr)
+			}
+			for _, escaped := range []string{filepath.Join(dir, "escaped.bin"), filepath.Join(outside, "escaped.bin")} {
+				if _, err := os.Stat(escaped); err == nil {
+					t.Fatalf("%q was written to %s", relPath, escaped)
+				}
+			}
+		}
+	}
+	if left, _ := filepath.Glob(filepath.Join(dest, "*.bin*")); len(left) > 0 {
+		t.Fatalf("%s was left behind", left[0])
+	}
+}
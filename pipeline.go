@@ -0,0 +1,256 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+)
+
+// The transfer pipeline. Sending, one goroutine reads the file, another encrypts, and the
+// caller writes to the connection; receiving, one reads the connection, another decrypts,
+// and the caller writes the file. Bounded channels between the stages let the disk, the
+// CPU, and the network work at the same time without any stage running far ahead, and the
+// chunk buffers go back to a pool once a stage is done with them, so a transfer doesn't
+// allocate a couple of megabytes per chunk.
+
+// how many chunks can wait between two stages
+const pipelineDepth = 4
+
+// chunkBuffers holds buffers big enough for any frame.
+var chunkBuffers = sync.Pool{New: func() interface{} {
+	b := make([]byte, maxFrameSize)
+	return &b
+}}
+
+func getBuffer() []byte {
+	return *chunkBuffers.Get().(*[]byte)
+}
+
+// putBuffer returns b to the pool. Only whole buffers from getBuffer go back.
+func putBuffer(b []byte) {
+	if cap(b) < maxFrameSize {
+		return
+	}
+	b = b[:cap(b)]
+	chunkBuffers.Put(&b)
+}
+
+// numberedChunk is a chunk of the file in one of the pipeline's stages. buf is the pooled
+// buffer data lives in, to be put back when the chunk is done with, and wire is how big the
+// chunk's frame is.
+type numberedChunk struct {
+	index int64
+	data  []byte
+	buf   []byte
+	wire  int64
+}
+
+// readChunks reads the file from offset to the end, a chunk at a time, hashing it in order.
+// Each chunk's data starts chunkHeadroom bytes into its buffer.
+func readChunks(r *parallelRun, file *os.File, offset, fileSize int64, hasher *fileHasher, out chan<- numberedChunk) {
+	defer close(out)
+	for i := offset / CHUNKSIZE; offset < fileSize; i++ {
+		n := min(CHUNKSIZE, fileSize-offset)
+		buf := getBuffer()
+		data := buf[chunkHeadroom : chunkHeadroom+n]
+		if bytesRead, err := io.ReadFull(file, data); err != nil {
+			r.fail(newTransferError(errLocalIO, fmt.Sprintf("Error reading out file (read %d of %d bytes):", bytesRead, n), err))
+			return
+		}
+		hasher.add(data)
+		offset += n
+		select {
+		case out <- numberedChunk{index: i, data: data, buf: buf}:
+		case <-r.ctx.Done():
+			return
+		}
+	}
+}
+
+// chunkHeaderSize is how much goes in front of a chunk's data in its plaintext: its index if
+// it's numbered, then its encoding if the peer supports compression.
+func chunkHeaderSize(t *Transfer, numbered bool) int {
+	size := 0
+	if numbered {
+		size += chunkIndexSize
+	}
+	if t.hasCapability(capCompression) {
+		size++
+	}
+	return size
+}
+
+// sealChunks seals chunks from in until it's closed.
+func sealChunks(r *parallelRun, t *Transfer, numbered, compress bool, in <-chan numberedChunk, out chan<- numberedChunk) {
+	for c := range in {
+		select {
+		case out <- sealChunk(t, numbered, compress, c):
+		case <-r.ctx.Done():
+			return
+		}
+	}
+}
+
+// sealChunk encrypts a chunk into a new pooled buffer, compressing it first if compress is
+// set and it makes it smaller, and puts the chunk's own buffer back.
+func sealChunk(t *Transfer, numbered, compress bool, c numberedChunk) numberedChunk {
+	headerSize := chunkHeaderSize(t, numbered)
+	plaintext := c.buf[chunkHeadroom-headerSize : chunkHeadroom+len(c.data)]
+	encoding := chunkRaw
+	var spare []byte
+	if compress {
+		spare = getBuffer()
+		if compressed, ok := compressChunk(spare[:headerSize], c.data); ok {
+			plaintext, encoding = compressed, chunkZstd
+		}
+	}
+	if numbered {
+		binary.BigEndian.PutUint64(plaintext, uint64(c.index))
+	}
+	if t.hasCapability(capCompression) {
+		plaintext[headerSize-1] = encoding
+	}
+
+	buf := getBuffer()
+	data := encryptTo(buf, plaintext, t.Key)
+	putBuffer(c.buf)
+	if spare != nil {
+		putBuffer(spare)
+	}
+	return numberedChunk{c.index, data, buf, int64(len(data))}
+}
+
+// openChunk decrypts and if need be decompresses a chunk frame into a pooled buffer. If
+// numbered, the chunk's index comes from its data, and must be one of this file's chunks
+// from first on.
+func openChunk(t *Transfer, frame []byte, numbered bool, first, fileSize int64) (numberedChunk, error) {
+	buf := getBuffer()
+	plaintext, err := decryptTo(buf, frame, t.Key)
+	if err != nil || len(plaintext) < chunkHeaderSize(t, numbered) {
+		putBuffer(buf)
+		if err == nil {
+			err = newTransferError(errTamperedChunk, "Received chunk is too short to be valid.", nil)
+		}
+		return numberedChunk{}, err
+	}
+	c := numberedChunk{data: plaintext, buf: buf, wire: int64(len(frame))}
+	if numbered {
+		c.index, c.data = int64(binary.BigEndian.Uint64(c.data)), c.data[chunkIndexSize:]
+	}
+	if t.hasCapability(capCompression) {
+		encoding := c.data[0]
+		c.data = c.data[1:]
+		switch encoding {
+		case chunkRaw:
+		case chunkZstd:
+			out := getBuffer()
+			decompressed, err := decompressChunk(out, c.data)
+			putBuffer(buf)
+			if err != nil {
+				putBuffer(out)
+				return c, err
+			}
+			c.data, c.buf = decompressed, out
+		default:
+			putBuffer(buf)
+			return c, newTransferError(errTamperedChunk, fmt.Sprintf("Received chunk with unknown encoding %d.", encoding), nil)
+		}
+	}
+	if numbered && (c.index < first || c.index >= ceil(fileSize, CHUNKSIZE) || int64(len(c.data)) != min(CHUNKSIZE, fileSize-c.index*CHUNKSIZE)) {
+		putBuffer(c.buf)
+		return c, newTransferError(errTamperedChunk, fmt.Sprintf("Received chunk %d, which isn't part of this file.", c.index), nil)
+	}
+	return c, nil
+}
+
+// sendChunks sends the file from offset to the end over conn.
+func sendChunks(conn net.Conn, t *Transfer, file *os.File, offset, fileSize int64, compress bool, hasher *fileHasher, progress *fileProgress) error {
+	r := newParallelRun(t, []net.Conn{conn})
+	plain := make(chan numberedChunk, pipelineDepth)
+	sealed := make(chan numberedChunk, pipelineDepth)
+	go readChunks(r, file, offset, fileSize, hasher, plain)
+	go func() {
+		defer close(sealed)
+		sealChunks(r, t, false, compress, plain, sealed)
+	}()
+
+	for c := range sealed {
+		if err := writeFrame(conn, frameChunk, c.data); err != nil {
+			r.fail(streamError("Send error:", err))
+			break
+		}
+		putBuffer(c.buf)
+		progress.chunkDone(min(CHUNKSIZE, fileSize-c.index*CHUNKSIZE), c.wire)
+	}
+	return r.finish("chunkAndSend")
+}
+
+// receiveChunks receives the rest of the file over conn up to the end of file, writing it at
+// outFile's position and journaling each chunk, and returns the trailer if one was sent. If
+// the file's data is coming over data streams instead, only the trailer is expected.
+func receiveChunks(conn net.Conn, t *Transfer, outFile *os.File, j *journal, hasher *fileHasher, progress *fileProgress) (trailer []byte, err error) {
+	r := newParallelRun(t, []net.Conn{conn})
+	frames := make(chan []byte, pipelineDepth)
+	opened := make(chan numberedChunk, pipelineDepth)
+
+	go func() {
+		// chunks read off the connection are kept even if the transfer is failing, so an
+		// interrupted transfer can resume after them
+		defer close(frames)
+		for {
+			ft, payload, err := readFrameInto(conn, getBuffer())
+			if err != nil {
+				if _, ok := err.(*transferError); ok {
+					r.fail(err)
+				} else {
+					r.lost(streamError("Error reading from stream:", err))
+				}
+				return
+			}
+			switch {
+			case ft == frameEnd:
+				return
+			case ft == frameTrailer:
+				trailer = append([]byte(nil), payload...)
+				putBuffer(payload)
+			case ft == frameChunk && len(t.StreamConns) == 0:
+				frames <- payload
+			default:
+				r.fail(newTransferError(errTamperedChunk, fmt.Sprintf("Expected file data from peer but received frame type %d.", ft), nil))
+				return
+			}
+		}
+	}()
+	go func() {
+		defer close(opened)
+		for frame := range frames {
+			c, err := openChunk(t, frame, false, 0, 0)
+			putBuffer(frame)
+			if err != nil {
+				r.fail(err)
+				continue
+			}
+			opened <- c
+		}
+	}()
+
+	writing := true
+	for c := range opened {
+		if writing {
+			if _, err = outFile.Write(c.data); err != nil {
+				r.fail(newTransferError(errLocalIO, "Error writing to out file:", err))
+				writing = false
+			} else if err = j.record(hasher.add(c.data)); err != nil {
+				r.fail(err)
+				writing = false
+			} else {
+				progress.chunkDone(int64(len(c.data)), c.wire)
+			}
+		}
+		putBuffer(c.buf)
+	}
+	return trailer, r.finish("receiveAndAssemble")
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+)
+
+// Wire protocol. Right after the TCP connection is made, each end sends a preamble: the
+// magic bytes, its protocol version, the oldest version it can talk to, and a bitmask of
+// the optional features it supports. The dialing end goes first and the listening end
+// answers with its own. From then on, everything is sent as frames: a one-byte frame type,
+// a four-byte big-endian payload length, and the payload.
+
+const protocolMagic = "FLYC"
+
+// protocolVersion 1 was the original unframed stream of int64s, which had no preamble.
+const protocolVersion = 2
+const minProtocolVersion = 2
+
+// optional features, negotiated in the preamble. both ends must support one to use it.
+const (
+	capResume uint32 = 1 << iota
+	capDirectories
+	capIntegrity
+	capMultiStream
+	capCompression
+	capDuplex // only offered when this end wants a two-way session
+	capManifest
+	capMetadata
+	capXattrs // only offered when this end wants extended attributes copied
+)
+
+const ourCapabilities = capResume | capDirectories | capIntegrity | capMultiStream | capCompression | capDuplex | capManifest | capMetadata | capXattrs
+
+// offeredCapabilities is what this end tells the peer it supports for this transfer.
+func (t *Transfer) offeredCapabilities() uint32 {
+	caps := uint32(ourCapabilities)
+	if !t.Duplex {
+		caps &^= capDuplex
+	}
+	if !t.Xattrs {
+		caps &^= capXattrs
+	}
+	return caps
+}
+
+// frame types
+const (
+	frameKeyExchange byte = iota + 1
+	frameCount
+	frameHeader
+	frameResume
+	frameChunk
+	frameEnd
+	frameAck
+	frameTrailer
+	frameStreams
+	frameJoin
+	frameManifest
+	frameHashRequest
+	frameHashes
+	frameSelection
+)
+
+const maxFrameSize = maxChunkSize + 1024
+
+// how long each end waits for the other during the preamble and key exchange. An older
+// version of Flying Carpet on the receiving end never answers the preamble at all. Tests
+// shorten it.
+var handshakeTimeout = 30 * time.Second
+
+// negotiateProtocol exchanges preambles with the peer and records the features both ends
+// support. Nothing is authenticated yet, so it also keeps both preambles for the key
+// exchange to check that each end saw what the other sent.
+func negotiateProtocol(pConn *net.Conn, t *Transfer) (err error) {
+	conn := *pConn
+	defer readDeadline(t.Ctx, conn, handshakeTimeout)()
+	defer func() { err = t.canceled(err, "negotiateProtocol") }()
+	var ours, theirs []byte
+	var peerVersion uint16
+	var peerCaps uint32
+	if t.Mode == "sending" {
+		if ours, err = writePreamble(conn, t.offeredCapabilities()); err != nil {
+			return err
+		}
+		if theirs, peerVersion, peerCaps, err = readPreamble(conn); err != nil {
+			return err
+		}
+		t.preambles = append(ours, theirs...)
+	} else {
+		// answer even if we can't talk to the dialer, so it can tell the user what's wrong
+		theirs, peerVersion, peerCaps, err = readPreamble(conn)
+		if err != nil && peerVersion == 0 {
+			return err
+		}
+		var writeErr error
+		ours, writeErr = writePreamble(conn, t.offeredCapabilities())
+		if err != nil {
+			return err
+		}
+		if writeErr != nil {
+			return writeErr
+		}
+		t.preambles = append(theirs, ours...)
+	}
+	t.Capabilities = peerCaps & t.offeredCapabilities()
+	return nil
+}
+
+func writePreamble(conn net.Conn, caps uint32) ([]byte, error) {
+	preamble := new(bytes.Buffer)
+	preamble.WriteString(protocolMagic)
+	binary.Write(preamble, binary.BigEndian, uint16(protocolVersion))
+	binary.Write(preamble, binary.BigEndian, uint16(minProtocolVersion))
+	binary.Write(preamble, binary.BigEndian, caps)
+	if _, err := conn.Write(preamble.Bytes()); err != nil {
+		return nil, streamError("Error sending protocol version:", err)
+	}
+	return preamble.Bytes(), nil
+}
+
+// readPreamble returns the peer's preamble, version, and capabilities. If the peer's version
+// is one we can't talk to, the version is returned along with the error.
+func readPreamble(conn net.Conn) (preamble []byte, version uint16, caps uint32, err error) {
+	preamble = make([]byte, len(protocolMagic)+2+2+4)
+	if _, err = io.ReadFull(conn, preamble); err != nil {
+		if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			return nil, 0, 0, newTransferError(errIncompatiblePeer, "Peer didn't send its protocol version. It's probably running an older, incompatible version of Flying Carpet. Please use the same version on both ends.", nil)
+		}
+		return nil, 0, 0, streamError("Error receiving protocol version:", err)
+	}
+	if string(preamble[:len(protocolMagic)]) != protocolMagic {
+		return nil, 0, 0, newTransferError(errIncompatiblePeer, "Peer is running an older, incompatible version of Flying Carpet. Please use the same version on both ends.", nil)
+	}
+	fields := preamble[len(protocolMagic):]
+	version = binary.BigEndian.Uint16(fields[0:])
+	peerMin := binary.BigEndian.Uint16(fields[2:])
+	caps = binary.BigEndian.Uint32(fields[4:])
+	if version < minProtocolVersion {
+		return nil, version, 0, newTransferError(errIncompatiblePeer, fmt.Sprintf("Peer is running incompatible protocol version %d, this end needs at least version %d. Please update Flying Carpet on the other end.", version, minProtocolVersion), nil)
+	}
+	if peerMin > protocolVersion {
+		return nil, version, 0, newTransferError(errIncompatiblePeer, fmt.Sprintf("Peer is running incompatible protocol version %d and can't talk to version %d. Please update Flying Carpet on this end.", version, protocolVersion), nil)
+	}
+	return preamble, version, caps, nil
+}
+
+func (t *Transfer) hasCapability(c uint32) bool {
+	return t.Capabilities&c != 0
+}
+
+// readDeadline makes reads on conn give up after timeout, or sooner if ctx ends first. The
+// returned function clears the deadline.
+func readDeadline(ctx context.Context, conn net.Conn, timeout time.Duration) (clear func()) {
+	deadline := time.Now().Add(timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	conn.SetReadDeadline(deadline)
+	done, exited := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(exited)
+		select {
+		case <-ctx.Done():
+			conn.SetReadDeadline(time.Now())
+		case <-done:
+		}
+	}()
+	return func() {
+		close(done)
+		<-exited
+		conn.SetReadDeadline(time.Time{})
+	}
+}
+
+// canceled is err, unless the transfer was canceled, in which case it says so instead: a
+// read readDeadline cut short isn't the peer's fault.
+func (t *Transfer) canceled(err error, what string) error {
+	if err != nil && t.Ctx.Err() != nil {
+		return errors.New("Exiting " + what + ", transfer was canceled.")
+	}
+	return err
+}
+
+// writeFrame writes a frame, sealing it first if conn is a sealedConn.
+func writeFrame(conn net.Conn, ft byte, payload []byte) error {
+	if s, ok := conn.(*sealedConn); ok && ft != frameChunk {
+		return s.writeFrame(ft, payload)
+	}
+	return writeRawFrame(conn, ft, payload)
+}
+
+func writeRawFrame(conn net.Conn, ft byte, payload []byte) error {
+	header := make([]byte, 5)
+	header[0] = ft
+	binary.BigEndian.PutUint32(header[1:], uint32(len(payload)))
+	if len(payload) == 0 {
+		_, err := conn.Write(header)
+		return err
+	}
+	buffers := net.Buffers{header, payload}
+	_, err := buffers.WriteTo(conn)
+	return err
+}
+
+func readFrame(conn net.Conn) (ft byte, payload []byte, err error) {
+	return readFrameInto(conn, nil)
+}
+
+// readFrameInto is readFrame, reading the payload into buf if it's big enough. If conn is a
+// sealedConn, the frame is opened.
+func readFrameInto(conn net.Conn, buf []byte) (ft byte, payload []byte, err error) {
+	var header [5]byte
+	if _, err = io.ReadFull(conn, header[:]); err != nil {
+		return 0, nil, err
+	}
+	length := binary.BigEndian.Uint32(header[1:])
+	if length > maxFrameSize {
+		return 0, nil, newTransferError(errTamperedChunk, fmt.Sprintf("Received frame of invalid size %d.", length), nil)
+	}
+	s, sealed := conn.(*sealedConn)
+	sealed = sealed && header[0] != frameChunk
+	if uint32(cap(buf)) >= length && !sealed {
+		payload = buf[:length]
+	} else {
+		payload = make([]byte, length)
+	}
+	if _, err = io.ReadFull(conn, payload); err != nil {
+		return 0, nil, err
+	}
+	if sealed {
+		if payload, err = s.open(header[0], payload, buf); err != nil {
+			return 0, nil, err
+		}
+	}
+	return header[0], payload, nil
+}
+
+// expectFrame reads the next frame and makes sure it's the type the protocol calls for.
+func expectFrame(conn net.Conn, want byte, what string) ([]byte, error) {
+	ft, payload, err := readFrame(conn)
+	if err != nil {
+		if _, ok := err.(*transferError); ok {
+			return nil, err
+		}
+		return nil, streamError("Error receiving "+what+":", err)
+	}
+	if ft != want {
+		return nil, newTransferError(errTamperedChunk, fmt.Sprintf("Expected %s from peer but received frame type %d.", what, ft), nil)
+	}
+	return payload, nil
+}
+
+func writeInt64Frame(conn net.Conn, ft byte, n int64) error {
+	payload := make([]byte, 8)
+	binary.BigEndian.PutUint64(payload, uint64(n))
+	return writeFrame(conn, ft, payload)
+}
+
+func expectInt64Frame(conn net.Conn, want byte, what string) (int64, error) {
+	payload, err := expectFrame(conn, want, what)
+	if err != nil {
+		return 0, err
+	}
+	if len(payload) != 8 {
+		return 0, newTransferError(errTamperedChunk, "Received malformed "+what+".", nil)
+	}
+	return int64(binary.BigEndian.Uint64(payload)), nil
+}
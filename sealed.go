@@ -0,0 +1,79 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"golang.org/x/crypto/nacl/secretbox"
+	"net"
+	"sync"
+)
+
+// Sealed frames. Once the key exchange is done, every connection of the session is wrapped in
+// a sealedConn, and writeFrame and readFrame seal and open each frame on it with a key derived
+// from the session key. A frame's nonce is made from the connection it's on, which end wrote
+// it, its type, and how many frames that end had sealed on that connection before it. None of
+// that is sent, and the session key is new every session, so a frame that's been replayed,
+// reordered, dropped, moved to another connection, sent back to the end that wrote it, or
+// given another type doesn't open.
+//
+// Chunks are the exception. They're sealed on their own already, so sealing them again would
+// only cost time: on data streams their number is sealed in with them, and on the session's
+// connection the file's hashes in the sealed trailer cover them.
+
+// which connection of the session a sealedConn is
+const (
+	sealSession byte = 0  // the session's connection
+	sealDuplex  byte = 1  // plus the mux channel, for each direction of a two-way session
+	sealStream  byte = 16 // plus the stream's index, for data streams
+)
+
+type sealedConn struct {
+	net.Conn
+	key    [32]byte
+	label  byte
+	dialer bool // whether this end dialed the session
+
+	writeLock sync.Mutex
+	sent      uint64
+	received  uint64
+}
+
+// newSealedConn wraps conn, which the key exchange has been done for, so frames on it are
+// sealed. Both ends have to wrap it with the same label.
+func newSealedConn(conn net.Conn, key *[32]byte, label byte, dialer bool) *sealedConn {
+	c := &sealedConn{Conn: conn, label: label, dialer: dialer}
+	mac := hmac.New(sha256.New, key[:])
+	mac.Write([]byte("frames"))
+	copy(c.key[:], mac.Sum(nil))
+	return c
+}
+
+func (c *sealedConn) nonce(byDialer bool, ft byte, n uint64) *[24]byte {
+	var nonce [24]byte
+	nonce[0] = c.label
+	if byDialer {
+		nonce[1] = 1
+	}
+	nonce[2] = ft
+	binary.BigEndian.PutUint64(nonce[3:], n)
+	return &nonce
+}
+
+func (c *sealedConn) writeFrame(ft byte, payload []byte) error {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+	sealed := secretbox.Seal(nil, payload, c.nonce(c.dialer, ft, c.sent), &c.key)
+	c.sent++
+	return writeRawFrame(c.Conn, ft, sealed)
+}
+
+// open opens the next frame from the peer, appending to dst[:0]. dst can't overlap sealed.
+func (c *sealedConn) open(ft byte, sealed, dst []byte) ([]byte, error) {
+	payload, ok := secretbox.Open(dst[:0], sealed, c.nonce(!c.dialer, ft, c.received), &c.key)
+	if !ok {
+		return nil, newTransferError(errTamperedChunk, "Received frame failed authentication. It was corrupted, replayed, or tampered with in transit.", nil)
+	}
+	c.received++
+	return payload, nil
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// settings are the defaults that persist between runs, whether set from the GUI or with
+// `flyingcarpet settings`. They're kept as JSON in the user's config folder.
+type settings struct {
+	OnConflict  conflictPolicy `json:"onConflict"`
+	KeepPartial bool           `json:"keepPartialFiles"`   // keep what was received of a failed transfer to resume from
+	Xattrs      bool           `json:"extendedAttributes"` // copy files' extended attributes, if the peer also wants to
+}
+
+func defaultSettings() settings {
+	return settings{OnConflict: conflictRename, KeepPartial: true}
+}
+
+func settingsPath() (string, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "FlyingCarpet", "settings.json"), nil
+}
+
+// loadSettings returns the saved settings, with the defaults for anything missing or invalid.
+func loadSettings() settings {
+	s := defaultSettings()
+	path, err := settingsPath()
+	if err != nil {
+		return s
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return s
+	}
+	if json.Unmarshal(data, &s) != nil {
+		return defaultSettings()
+	}
+	if _, err = parseConflictPolicy(string(s.OnConflict)); err != nil {
+		s.OnConflict = defaultSettings().OnConflict
+	}
+	return s
+}
+
+func saveSettings(s settings) error {
+	path, err := settingsPath()
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, append(data, '\n'), 0600)
+}
@@ -0,0 +1,417 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"runtime"
+	"sync"
+	"time"
+)
+
+// Multi-stream transfers. One TCP connection tops out well below what fast WiFi can carry,
+// so the sending end can open extra data streams to the receiving end once the key exchange
+// is done. The connection the session started on keeps carrying everything but file data:
+// headers, resume offsets, trailers, and acks. Each file's chunks are spread over the data
+// streams, numbered so the receiving end can put them in place as they arrive.
+//
+// A data stream proves it belongs to the session by sending a join frame tagged with the
+// session key, and its frames are sealed from then on. A chunk's number is encrypted along
+// with its data, so chunks can't be moved around undetected.
+
+const maxStreams = 16
+
+// how long the receiving end waits for the sending end's data streams to connect
+const streamJoinTimeout = 10 * time.Second
+
+// chunkIndexSize is the chunk number at the front of each chunk's plaintext on a data stream.
+const chunkIndexSize = 8
+
+// cryptoWorkers is how many chunks the sending end encrypts at once. The receiving end
+// decrypts on each data stream as it reads it.
+var cryptoWorkers = runtime.NumCPU()
+
+// how many chunks past the next one to be journaled a data stream can get before it has to
+// wait for the others. Tests shorten it.
+var maxReadAhead int64 = 64
+
+func streamTag(key *[32]byte, index int) []byte {
+	mac := hmac.New(sha256.New, key[:])
+	mac.Write([]byte{'s', 't', 'r', 'e', 'a', 'm', byte(index)})
+	return mac.Sum(nil)
+}
+
+// openStreams tells the receiving end how many data streams to expect and connects them.
+func openStreams(pConn *net.Conn, t *Transfer) error {
+	n := t.Streams
+	if n < 2 || !t.hasCapability(capMultiStream) || t.DialStream == nil {
+		n = 0
+	}
+	if n > maxStreams {
+		n = maxStreams
+	}
+	if t.hasCapability(capMultiStream) {
+		if err := writeInt64Frame(*pConn, frameStreams, int64(n)); err != nil {
+			return streamError("Error requesting data streams:", err)
+		}
+	}
+	for i := 0; i < n; i++ {
+		conn, err := t.DialStream()
+		if err != nil {
+			return fmt.Errorf("Could not open data stream %d of %d: %s", i+1, n, err)
+		}
+		t.StreamConns = append(t.StreamConns, newSealedConn(conn, t.Key, sealStream+byte(i), true))
+		if err = writeFrame(conn, frameJoin, append([]byte{byte(i)}, streamTag(t.Key, i)...)); err != nil {
+			return streamError("Error opening data stream:", err)
+		}
+	}
+	if n > 0 {
+		t.output(fmt.Sprintf("Sending over %d streams.", n))
+	}
+	return nil
+}
+
+// acceptStreams finds out how many data streams the sending end wants and waits for them to
+// join. Connections that can't prove they're part of this session are turned away.
+func acceptStreams(pConn *net.Conn, t *Transfer) error {
+	if !t.hasCapability(capMultiStream) {
+		return nil
+	}
+	n, err := expectInt64Frame(*pConn, frameStreams, "number of data streams")
+	if err != nil {
+		return err
+	}
+	if n < 0 || n > maxStreams || n > 0 && t.AcceptStream == nil {
+		return newTransferError(errTamperedChunk, fmt.Sprintf("Sending end asked for %d data streams.", n), nil)
+	}
+	conns := make([]net.Conn, n)
+	deadline := time.Now().Add(streamJoinTimeout)
+	for joined := int64(0); joined < n; {
+		if time.Now().After(deadline) {
+			t.StreamConns = conns
+			return newTransferError(errTruncatedStream, fmt.Sprintf("Only %d of %d data streams connected.", joined, n), nil)
+		}
+		conn, err := t.AcceptStream()
+		if err != nil {
+			continue
+		}
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		join, err := expectFrame(conn, frameJoin, "data stream")
+		conn.SetReadDeadline(time.Time{})
+		if err != nil || len(join) != 1+sha256.Size || int64(join[0]) >= n || conns[join[0]] != nil ||
+			!hmac.Equal(join[1:], streamTag(t.Key, int(join[0]))) {
+			conn.Close()
+			continue
+		}
+		conns[join[0]] = newSealedConn(conn, t.Key, sealStream+join[0], false)
+		joined++
+	}
+	t.StreamConns = conns
+	if n > 0 {
+		t.output(fmt.Sprintf("Receiving over %d streams.", n))
+	}
+	return nil
+}
+
+func closeStreams(t *Transfer) {
+	for _, conn := range t.StreamConns {
+		if conn != nil {
+			conn.Close()
+		}
+	}
+	t.StreamConns = nil
+}
+
+// parallelRun is what the goroutines moving one file share, whether they're the stages of
+// the pipeline or the data streams: the first error any of them hits, and a context that
+// stops the rest when that happens.
+type parallelRun struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	once   sync.Once
+	err    error
+	done   chan struct{}
+	exited chan struct{}
+}
+
+// newParallelRun starts a run. If it's stopped early, the deadlines of conns are set so any
+// goroutine blocked on one gives up.
+func newParallelRun(t *Transfer, conns []net.Conn) *parallelRun {
+	r := &parallelRun{done: make(chan struct{}), exited: make(chan struct{})}
+	r.ctx, r.cancel = context.WithCancel(t.Ctx)
+	go func() {
+		defer close(r.exited)
+		select {
+		case <-r.ctx.Done():
+			for _, conn := range conns {
+				conn.SetDeadline(time.Now())
+			}
+		case <-r.done:
+		}
+	}()
+	return r
+}
+
+func (r *parallelRun) fail(err error) {
+	r.lost(err)
+	r.cancel()
+}
+
+// lost records err without stopping the others, for when the peer went away: whatever it
+// already sent is still worth keeping.
+func (r *parallelRun) lost(err error) {
+	r.once.Do(func() { r.err = err })
+}
+
+// finish waits for the deadline watcher and returns the run's error, if any.
+func (r *parallelRun) finish(what string) error {
+	close(r.done)
+	<-r.exited
+	defer r.cancel()
+	if r.err != nil {
+		return r.err
+	}
+	if r.ctx.Err() != nil {
+		return errors.New("Exiting " + what + ", transfer was canceled.")
+	}
+	return nil
+}
+
+// sendChunksParallel sends the file from offset to the end as numbered chunks spread over
+// the data streams, encrypting them in a pool of workers. Each chunk gets a slot as it's
+// read, and the streams take the slots in order and wait for each to be sealed, so every
+// stream sends its chunks in order however the workers finish. The receiving end counts on
+// that when it holds a stream back.
+func sendChunksParallel(t *Transfer, file *os.File, offset, fileSize int64, compress bool, hasher *fileHasher, progress *fileProgress) error {
+	r := newParallelRun(t, t.StreamConns)
+	plain := make(chan numberedChunk, cryptoWorkers)
+	go readChunks(r, file, offset, fileSize, hasher, plain)
+
+	type sealJob struct {
+		chunk  numberedChunk
+		sealed chan numberedChunk
+	}
+	jobs := make(chan sealJob, cryptoWorkers)
+	slots := make(chan chan numberedChunk, cryptoWorkers+len(t.StreamConns))
+	go func() {
+		defer close(jobs)
+		defer close(slots)
+		for c := range plain {
+			job := sealJob{c, make(chan numberedChunk, 1)}
+			jobs <- job
+			select {
+			case slots <- job.sealed:
+			case <-r.ctx.Done():
+				return
+			}
+		}
+	}()
+	for w := 0; w < cryptoWorkers; w++ {
+		go func() {
+			for job := range jobs {
+				job.sealed <- sealChunk(t, true, compress, job.chunk)
+			}
+		}()
+	}
+
+	var writing sync.WaitGroup
+	for _, conn := range t.StreamConns {
+		writing.Add(1)
+		go func(conn net.Conn) {
+			defer writing.Done()
+			for slot := range slots {
+				var c numberedChunk
+				select {
+				case c = <-slot:
+				case <-r.ctx.Done():
+					return
+				}
+				if err := writeFrame(conn, frameChunk, c.data); err != nil {
+					r.fail(streamError("Send error:", err))
+					return
+				}
+				putBuffer(c.buf)
+				progress.chunkDone(min(CHUNKSIZE, fileSize-c.index*CHUNKSIZE), c.wire)
+			}
+			// this stream has nothing more of this file
+			if r.ctx.Err() == nil {
+				if err := writeFrame(conn, frameEnd, nil); err != nil {
+					r.fail(streamError("Error signalling end of file:", err))
+				}
+			}
+		}(conn)
+	}
+	writing.Wait()
+	return r.finish("chunkAndSend")
+}
+
+// readAhead is the next chunk to be hashed and journaled, for holding data streams back from
+// getting more than maxReadAhead chunks ahead of it.
+type readAhead struct {
+	lock     sync.Mutex
+	next     int64
+	released bool          // once a stream is lost, the chunks being waited for may never come
+	moved    chan struct{} // closed when next changes or the streams are released
+}
+
+func (a *readAhead) advance(next int64) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.next = next
+	close(a.moved)
+	a.moved = make(chan struct{})
+}
+
+// release stops holding streams back.
+func (a *readAhead) release() {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.released = true
+	close(a.moved)
+	a.moved = make(chan struct{})
+}
+
+// wait waits until chunk index is close enough to the next one to go ahead, or ctx is done.
+func (a *readAhead) wait(ctx context.Context, index int64) bool {
+	for {
+		a.lock.Lock()
+		next, released, moved := a.next, a.released, a.moved
+		a.lock.Unlock()
+		if released || index < next+maxReadAhead {
+			return true
+		}
+		select {
+		case <-moved:
+		case <-ctx.Done():
+			return false
+		}
+	}
+}
+
+// receiveChunksParallel receives the file from offset to the end over the data streams,
+// decrypting on each stream as it's read and writing each chunk in place as it arrives.
+// Chunks are hashed and journaled in order, so an interrupted transfer resumes after the
+// last chunk everything before which made it to disk. Once a chunk has been read off a
+// stream it's kept, even if the transfer is failing, for the same reason.
+//
+// A chunk that arrives before the ones ahead of it is only remembered, and read back off the
+// disk to be hashed once they're in, and a stream that gets maxReadAhead chunks ahead waits
+// for the others. The sending end sends each stream's chunks in order, so the chunk being
+// waited for is never behind one held back on the same stream.
+func receiveChunksParallel(t *Transfer, outFile *os.File, offset, fileSize int64, j *journal, hasher *fileHasher, progress *fileProgress) error {
+	r := newParallelRun(t, t.StreamConns)
+	first, end := offset/CHUNKSIZE, ceil(fileSize, CHUNKSIZE)
+	placed := make(chan numberedChunk, len(t.StreamConns))
+	ahead := &readAhead{next: first, moved: make(chan struct{})}
+
+	var reading sync.WaitGroup
+	for _, conn := range t.StreamConns {
+		reading.Add(1)
+		go func(conn net.Conn) {
+			defer reading.Done()
+			last := int64(-1)
+			for {
+				ft, payload, err := readFrameInto(conn, getBuffer())
+				if err != nil {
+					if _, ok := err.(*transferError); ok {
+						r.fail(err)
+					} else {
+						r.lost(streamError("Error reading from stream:", err))
+						ahead.release()
+					}
+					return
+				}
+				if ft == frameEnd {
+					return
+				}
+				if ft != frameChunk {
+					r.fail(newTransferError(errTamperedChunk, fmt.Sprintf("Expected file data from peer but received frame type %d.", ft), nil))
+					return
+				}
+				c, err := openChunk(t, payload, true, first, fileSize)
+				putBuffer(payload)
+				if err == nil && c.index <= last {
+					putBuffer(c.buf)
+					err = newTransferError(errTamperedChunk, fmt.Sprintf("Received chunk %d after chunk %d on the same stream.", c.index, last), nil)
+				}
+				if err != nil {
+					r.fail(err)
+					return
+				}
+				last = c.index
+				if !ahead.wait(r.ctx, c.index) {
+					putBuffer(c.buf)
+					return
+				}
+				if _, err = outFile.WriteAt(c.data, c.index*CHUNKSIZE); err != nil {
+					putBuffer(c.buf)
+					r.fail(newTransferError(errLocalIO, "Error writing to out file:", err))
+					return
+				}
+				placed <- c
+			}
+		}(conn)
+	}
+	go func() {
+		reading.Wait()
+		close(placed)
+	}()
+
+	// sizes of the chunks that are on disk but still waiting for the ones before them
+	type waitingChunk struct{ size, wire int64 }
+	waiting := map[int64]waitingChunk{}
+	next := first
+	recording := true
+	record := func(data []byte, wire int64) bool {
+		if err := j.record(hasher.add(data)); err != nil {
+			r.fail(err)
+			recording = false
+			return false
+		}
+		progress.chunkDone(int64(len(data)), wire)
+		next++
+		return true
+	}
+	for c := range placed {
+		if !recording {
+			putBuffer(c.buf)
+			continue
+		}
+		if _, dup := waiting[c.index]; dup || c.index < next {
+			putBuffer(c.buf)
+			r.fail(newTransferError(errTamperedChunk, fmt.Sprintf("Received chunk %d twice.", c.index), nil))
+			continue
+		}
+		if c.index != next {
+			waiting[c.index] = waitingChunk{int64(len(c.data)), c.wire}
+			putBuffer(c.buf)
+			continue
+		}
+		ok := record(c.data, c.wire)
+		putBuffer(c.buf)
+		for w, found := waiting[next]; ok && found; w, found = waiting[next] {
+			delete(waiting, next)
+			buf := getBuffer()
+			if _, err := outFile.ReadAt(buf[:w.size], next*CHUNKSIZE); err != nil {
+				putBuffer(buf)
+				r.fail(newTransferError(errLocalIO, "Error reading back out file:", err))
+				recording = false
+				break
+			}
+			ok = record(buf[:w.size], w.wire)
+			putBuffer(buf)
+		}
+		ahead.advance(next)
+	}
+	if err := r.finish("receiveAndAssemble"); err != nil {
+		return err
+	}
+	if next != end {
+		return newTransferError(errTruncatedStream, fmt.Sprintf("Data streams ended after %d of %d chunks.", next-first, end-first), nil)
+	}
+	return nil
+}
@@ -0,0 +1,871 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// End-to-end tests of the transfer protocol. Each runs a sending end and a receiving end in
+// this process, connected over a loopback TCP socket, through something that has broken
+// between laptops before. Nothing touches the network settings, so they run anywhere,
+// including CI.
+
+// testPair is one sending end and one receiving end.
+type testPair struct {
+	sender, receiver *Transfer
+	senderUI         *recordingUI
+	receiverUI       *recordingUI
+	// if set, wraps the sending end's side of the connection
+	wrapSender func(net.Conn) net.Conn
+	// if set, runs the sending end instead of sendFiles
+	send func(conn *net.Conn, t *Transfer) error
+}
+
+func newTestPair(files []string, dest string) *testPair {
+	p := &testPair{senderUI: &recordingUI{}, receiverUI: &recordingUI{}}
+	p.sender = &Transfer{Mode: "sending", FileList: files, Passphrase: "test", SSID: "flyingCarpet_selftest", UI: p.senderUI}
+	p.sender.Ctx, p.sender.CancelCtx = context.WithCancel(context.Background())
+	p.receiver = &Transfer{Mode: "receiving", Filepath: dest + string(os.PathSeparator), Passphrase: "test", SSID: "flyingCarpet_selftest", OnConflict: conflictRename, KeepPartial: true, UI: p.receiverUI}
+	p.receiver.Ctx, p.receiver.CancelCtx = context.WithCancel(context.Background())
+	return p
+}
+
+// run connects the two ends and runs a session, returning each end's error. Like mainRoutine,
+// each end closes its connection when it's done, which is how the other end finds out about
+// a failure. The ends are connected over loopback TCP rather than net.Pipe: they write to
+// each other at the same time, which needs the socket's buffering, and data streams have to
+// be able to dial in the same way.
+func (p *testPair) run() (sendErr, recvErr error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return err, err
+	}
+	defer ln.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			close(accepted)
+			return
+		}
+		accepted <- conn
+	}()
+	sendConn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		return err, err
+	}
+	recvConn, ok := <-accepted
+	if !ok {
+		sendConn.Close()
+		return errors.New("could not accept connection"), errors.New("could not accept connection")
+	}
+	if p.wrapSender != nil {
+		sendConn = p.wrapSender(sendConn)
+	}
+	// data streams connect the same way, to the same listener
+	p.sender.DialStream = func() (net.Conn, error) {
+		conn, err := net.Dial("tcp", ln.Addr().String())
+		if err == nil && p.wrapSender != nil {
+			conn = p.wrapSender(conn)
+		}
+		return conn, err
+	}
+	p.receiver.AcceptStream = func() (net.Conn, error) {
+		ln.(*net.TCPListener).SetDeadline(time.Now().Add(time.Second))
+		return ln.Accept()
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		defer sendConn.Close()
+		send := sendFiles
+		if p.send != nil {
+			send = p.send
+		}
+		sendErr = send(&sendConn, p.sender)
+	}()
+	go func() {
+		defer wg.Done()
+		defer recvConn.Close()
+		recvErr = receiveFiles(&recvConn, p.receiver)
+	}()
+	wg.Wait()
+	return
+}
+
+// recordingUI keeps the output so tests can check it. Offered files are all accepted unless
+// review says otherwise, and files that are already there renamed unless resolve does.
+type recordingUI struct {
+	lock    sync.Mutex
+	lines   []string
+	review  func(entries []manifestEntry, totalSize int64) []bool
+	resolve func(path string) conflictPolicy
+}
+
+func (u *recordingUI) Output(msg string) {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	u.lines = append(u.lines, msg)
+}
+
+func (u *recordingUI) contains(s string) bool {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	for _, line := range u.lines {
+		if strings.Contains(line, s) {
+			return true
+		}
+	}
+	return false
+}
+
+func (u *recordingUI) ShowPassword(password string) {}
+
+func (u *recordingUI) ReviewFiles(entries []manifestEntry, totalSize int64) []bool {
+	if u.review != nil {
+		return u.review(entries, totalSize)
+	}
+	accept := make([]bool, len(entries))
+	for i := range accept {
+		accept[i] = true
+	}
+	return accept
+}
+
+func (u *recordingUI) ResolveConflict(path string) conflictPolicy {
+	if u.resolve != nil {
+		return u.resolve(path)
+	}
+	return conflictRename
+}
+
+func (u *recordingUI) FileStarted(path string)    {}
+func (u *recordingUI) Progress(percentage int)    {}
+func (u *recordingUI) FileFinished(path string)   {}
+func (u *recordingUI) TransferFinished(err error) {}
+
+// chunkHook wraps a connection and calls hook with the payload of each chunk frame written
+// to it, in order. writeFrame writes the frame header and payload separately, so a write
+// that follows a chunk header is the chunk.
+type chunkHook struct {
+	net.Conn
+	afterChunkHeader bool
+	chunks           int
+	hook             func(conn net.Conn, n int, payload []byte) (int, error)
+}
+
+func (c *chunkHook) Write(b []byte) (int, error) {
+	if c.afterChunkHeader {
+		c.afterChunkHeader = false
+		c.chunks++
+		return c.hook(c.Conn, c.chunks, b)
+	}
+	c.afterChunkHeader = len(b) == 5 && b[0] == frameChunk
+	return c.Conn.Write(b)
+}
+
+func writeRandomFile(path string, size int) ([]byte, error) {
+	data := make([]byte, size)
+	if _, err := rand.Read(data); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	return data, ioutil.WriteFile(path, data, 0644)
+}
+
+func checkFile(path string, want []byte) error {
+	got, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(got, want) {
+		return fmt.Errorf("%s has %d bytes that don't match the %d sent", path, len(got), len(want))
+	}
+	return nil
+}
+
+func checkBothSucceeded(sendErr, recvErr error) error {
+	if sendErr != nil {
+		return fmt.Errorf("sending end failed: %s", sendErr)
+	}
+	if recvErr != nil {
+		return fmt.Errorf("receiving end failed: %s", recvErr)
+	}
+	return nil
+}
+
+// transferOneFile sends a single random file of the given size and checks it arrives intact.
+func transferOneFile(t *testing.T, size int) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src", "file.bin")
+	data, err := writeRandomFile(src, size)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dest := filepath.Join(dir, "dest")
+	if err = os.Mkdir(dest, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err = checkBothSucceeded(newTestPair([]string{src}, dest).run()); err != nil {
+		t.Fatal(err)
+	}
+	if err = checkFile(filepath.Join(dest, "file.bin"), data); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestZeroByteFile(t *testing.T) {
+	transferOneFile(t, 0)
+}
+
+func TestExactChunks(t *testing.T) {
+	transferOneFile(t, 2*CHUNKSIZE)
+}
+
+func TestChunkPlusOne(t *testing.T) {
+	transferOneFile(t, CHUNKSIZE+1)
+}
+
+func TestMultipleFiles(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src")
+	sent := map[string][]byte{}
+	for name, size := range map[string]int{"top.bin": CHUNKSIZE / 2, "folder/a.bin": CHUNKSIZE + CHUNKSIZE/3, "folder/sub/b.txt": 10} {
+		data, err := writeRandomFile(filepath.Join(src, filepath.FromSlash(name)), size)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sent[name] = data
+	}
+	if err := os.MkdirAll(filepath.Join(src, "folder", "empty"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	dest := filepath.Join(dir, "dest")
+	if err := os.Mkdir(dest, 0755); err != nil {
+		t.Fatal(err)
+	}
+	files := []string{filepath.Join(src, "top.bin"), filepath.Join(src, "folder")}
+	if err := checkBothSucceeded(newTestPair(files, dest).run()); err != nil {
+		t.Fatal(err)
+	}
+	for name, data := range sent {
+		if err := checkFile(filepath.Join(dest, filepath.FromSlash(name)), data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if info, err := os.Stat(filepath.Join(dest, "folder", "empty")); err != nil || !info.IsDir() {
+		t.Fatal("empty folder was not created")
+	}
+}
+
+func TestCancelAndResume(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src", "big.bin")
+	data, err := writeRandomFile(src, 3*CHUNKSIZE+100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dest := filepath.Join(dir, "dest")
+	if err = os.Mkdir(dest, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	// cancel partway through writing the second chunk
+	p := newTestPair([]string{src}, dest)
+	p.wrapSender = func(conn net.Conn) net.Conn {
+		return &chunkHook{Conn: conn, hook: func(conn net.Conn, n int, payload []byte) (int, error) {
+			if n < 2 {
+				return conn.Write(payload)
+			}
+			conn.Write(payload[:len(payload)/2])
+			p.sender.CancelCtx()
+			conn.Close()
+			return 0, errors.New("transfer was canceled")
+		}}
+	}
+	sendErr, recvErr := p.run()
+	if sendErr == nil {
+		t.Fatal("sending end didn't notice the cancellation")
+	}
+	if !isErrorKind(recvErr, errTruncatedStream) {
+		t.Fatalf("receiving end should have lost the connection, got: %v", recvErr)
+	}
+	part := filepath.Join(dest, "big.bin"+partSuffix)
+	if _, err = os.Stat(journalPath(part)); err != nil {
+		t.Fatal("no journal left behind to resume from")
+	}
+	if _, err = os.Stat(filepath.Join(dest, "big.bin")); err == nil {
+		t.Fatal("partial file has the real file's name")
+	}
+
+	// run it again and it should pick up after the first chunk
+	p = newTestPair([]string{src}, dest)
+	if err = checkBothSucceeded(p.run()); err != nil {
+		t.Fatal(err)
+	}
+	if !p.receiverUI.contains("Resuming interrupted transfer") {
+		t.Fatal("second transfer started over instead of resuming")
+	}
+	if _, err = os.Stat(journalPath(part)); err == nil {
+		t.Fatal("journal was not removed after the file was complete")
+	}
+	if _, err = os.Stat(part); err == nil {
+		t.Fatal("partial file was left behind after the file was complete")
+	}
+	if err = checkFile(filepath.Join(dest, "big.bin"), data); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCancelWithoutKeeping(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src", "big.bin")
+	if _, err := writeRandomFile(src, 3*CHUNKSIZE+100); err != nil {
+		t.Fatal(err)
+	}
+	dest := filepath.Join(dir, "dest")
+	if err := os.Mkdir(dest, 0755); err != nil {
+		t.Fatal(err)
+	}
+	p := newTestPair([]string{src}, dest)
+	p.receiver.KeepPartial = false
+	p.wrapSender = func(conn net.Conn) net.Conn {
+		return &chunkHook{Conn: conn, hook: func(conn net.Conn, n int, payload []byte) (int, error) {
+			if n < 2 {
+				return conn.Write(payload)
+			}
+			p.sender.CancelCtx()
+			conn.Close()
+			return 0, errors.New("transfer was canceled")
+		}}
+	}
+	if _, recvErr := p.run(); recvErr == nil {
+		t.Fatal("receiving end didn't notice the cancellation")
+	}
+	left, err := ioutil.ReadDir(dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(left) > 0 {
+		t.Fatalf("%s was left behind", left[0].Name())
+	}
+}
+
+func TestWrongPassword(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src", "file.bin")
+	if _, err := writeRandomFile(src, 1000); err != nil {
+		t.Fatal(err)
+	}
+	dest := filepath.Join(dir, "dest")
+	if err := os.Mkdir(dest, 0755); err != nil {
+		t.Fatal(err)
+	}
+	p := newTestPair([]string{src}, dest)
+	p.sender.Passphrase = "tset"
+	sendErr, recvErr := p.run()
+	if !isErrorKind(sendErr, errBadPassword) {
+		t.Fatalf("sending end should have reported a wrong password, got: %v", sendErr)
+	}
+	if !isErrorKind(recvErr, errBadPassword) {
+		t.Fatalf("receiving end should have reported a wrong password, got: %v", recvErr)
+	}
+	if _, err := os.Stat(filepath.Join(dest, "file.bin")); err == nil {
+		t.Fatal("file was received despite the wrong password")
+	}
+}
+
+// preambleHook wraps a connection and lets hook rewrite the first thing written to it, which
+// is the preamble.
+type preambleHook struct {
+	net.Conn
+	written bool
+	hook    func(preamble []byte)
+}
+
+func (c *preambleHook) Write(b []byte) (int, error) {
+	if !c.written {
+		c.written = true
+		b = append([]byte(nil), b...)
+		c.hook(b)
+	}
+	return c.Conn.Write(b)
+}
+
+func TestStrippedCapabilities(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src", "file.bin")
+	if _, err := writeRandomFile(src, 1000); err != nil {
+		t.Fatal(err)
+	}
+	dest := filepath.Join(dir, "dest")
+	if err := os.Mkdir(dest, 0755); err != nil {
+		t.Fatal(err)
+	}
+	// someone on the network turns off integrity checks and resume before the receiving end sees them
+	p := newTestPair([]string{src}, dest)
+	p.wrapSender = func(conn net.Conn) net.Conn {
+		return &preambleHook{Conn: conn, hook: func(preamble []byte) {
+			caps := binary.BigEndian.Uint32(preamble[len(protocolMagic)+4:])
+			binary.BigEndian.PutUint32(preamble[len(protocolMagic)+4:], caps&^(capIntegrity|capResume))
+		}}
+	}
+	sendErr, recvErr := p.run()
+	if !isErrorKind(sendErr, errBadPassword) {
+		t.Fatalf("sending end should have failed the key exchange, got: %v", sendErr)
+	}
+	if !isErrorKind(recvErr, errBadPassword) {
+		t.Fatalf("receiving end should have failed the key exchange, got: %v", recvErr)
+	}
+	if _, err := os.Stat(filepath.Join(dest, "file.bin")); err == nil {
+		t.Fatal("file was received over a tampered connection")
+	}
+}
+
+func TestOldReceiver(t *testing.T) {
+	defer func(timeout time.Duration) { handshakeTimeout = timeout }(handshakeTimeout)
+	handshakeTimeout = 200 * time.Millisecond
+	// an older version takes the preamble for the start of its own protocol and waits for more
+	sendConn, recvConn := net.Pipe()
+	defer recvConn.Close()
+	go io.Copy(ioutil.Discard, recvConn)
+	p := newTestPair(nil, t.TempDir())
+	err := sendFiles(&sendConn, p.sender)
+	sendConn.Close()
+	if !isErrorKind(err, errIncompatiblePeer) {
+		t.Fatalf("sending end should have reported an incompatible peer, got: %v", err)
+	}
+}
+
+func TestCancelDuringHandshake(t *testing.T) {
+	sendConn, recvConn := net.Pipe()
+	defer recvConn.Close()
+	go io.Copy(ioutil.Discard, recvConn)
+	p := newTestPair(nil, t.TempDir())
+	time.AfterFunc(100*time.Millisecond, p.sender.CancelCtx)
+	err := sendFiles(&sendConn, p.sender)
+	sendConn.Close()
+	if err == nil || !strings.Contains(err.Error(), "canceled") {
+		t.Fatalf("sending end should have stopped when canceled, got: %v", err)
+	}
+}
+
+// wireRecorder wraps a connection and keeps a copy of everything sent and received over it.
+type wireRecorder struct {
+	net.Conn
+	lock sync.Mutex
+	wire bytes.Buffer
+}
+
+func (c *wireRecorder) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.wire.Write(b[:n])
+	return n, err
+}
+
+func (c *wireRecorder) Write(b []byte) (int, error) {
+	c.lock.Lock()
+	c.wire.Write(b)
+	c.lock.Unlock()
+	return c.Conn.Write(b)
+}
+
+func (c *wireRecorder) contains(b []byte) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return bytes.Contains(c.wire.Bytes(), b)
+}
+
+func TestTrailerSealed(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src", "file.bin")
+	data, err := writeRandomFile(src, CHUNKSIZE+1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dest := filepath.Join(dir, "dest")
+	if err = os.Mkdir(dest, 0755); err != nil {
+		t.Fatal(err)
+	}
+	p := newTestPair([]string{src}, dest)
+	var recorders []*wireRecorder
+	p.wrapSender = func(conn net.Conn) net.Conn {
+		r := &wireRecorder{Conn: conn}
+		recorders = append(recorders, r)
+		return r
+	}
+	if err = checkBothSucceeded(p.run()); err != nil {
+		t.Fatal(err)
+	}
+	if err = checkFile(filepath.Join(dest, "file.bin"), data); err != nil {
+		t.Fatal(err)
+	}
+	hash := sha256.Sum256(data)
+	for _, r := range recorders {
+		if r.contains(hash[:]) {
+			t.Fatal("the file's hash was sent in the clear")
+		}
+	}
+}
+
+// ackDropper wraps a connection and throws away the acknowledgements read from it.
+type ackDropper struct {
+	net.Conn
+	pending  []byte
+	preamble bool // whether the preamble, which isn't a frame, has been read
+}
+
+func (c *ackDropper) Read(b []byte) (int, error) {
+	for len(c.pending) == 0 {
+		if !c.preamble {
+			c.preamble = true
+			c.pending = make([]byte, len(protocolMagic)+2+2+4)
+			if _, err := io.ReadFull(c.Conn, c.pending); err != nil {
+				return 0, err
+			}
+			break
+		}
+		header := make([]byte, 5)
+		if _, err := io.ReadFull(c.Conn, header); err != nil {
+			return 0, err
+		}
+		frame := append(header, make([]byte, binary.BigEndian.Uint32(header[1:]))...)
+		if _, err := io.ReadFull(c.Conn, frame[5:]); err != nil {
+			return 0, err
+		}
+		if header[0] != frameAck {
+			c.pending = frame
+		}
+	}
+	n := copy(b, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+func TestMissingAck(t *testing.T) {
+	defer func(timeout time.Duration) { ackTimeout = timeout }(ackTimeout)
+	ackTimeout = 200 * time.Millisecond
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src", "file.bin")
+	if _, err := writeRandomFile(src, 1000); err != nil {
+		t.Fatal(err)
+	}
+	dest := filepath.Join(dir, "dest")
+	if err := os.Mkdir(dest, 0755); err != nil {
+		t.Fatal(err)
+	}
+	p := newTestPair([]string{src}, dest)
+	p.wrapSender = func(conn net.Conn) net.Conn {
+		return &ackDropper{Conn: conn}
+	}
+	sendErr, _ := p.run()
+	if sendErr == nil || !strings.Contains(sendErr.Error(), "acknowledgement") {
+		t.Fatalf("sending end should have failed without an acknowledgement, got: %v", sendErr)
+	}
+}
+
+func TestSaveFailed(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src", "file.bin")
+	if _, err := writeRandomFile(src, 1000); err != nil {
+		t.Fatal(err)
+	}
+	// a folder that's in the way can't be replaced by the received file
+	dest := filepath.Join(dir, "dest")
+	if _, err := writeRandomFile(filepath.Join(dest, "file.bin", "keep.bin"), 10); err != nil {
+		t.Fatal(err)
+	}
+	p := newTestPair([]string{src}, dest)
+	p.receiver.OnConflict = conflictOverwrite
+	sendErr, recvErr := p.run()
+	if !isErrorKind(recvErr, errLocalIO) {
+		t.Fatalf("receiving end should have failed to save the file, got: %v", recvErr)
+	}
+	if sendErr == nil || !strings.Contains(sendErr.Error(), "could not save") {
+		t.Fatalf("sending end should have been told the file wasn't saved, got: %v", sendErr)
+	}
+}
+
+func TestCorruptedChunk(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src", "file.bin")
+	if _, err := writeRandomFile(src, 2*CHUNKSIZE); err != nil {
+		t.Fatal(err)
+	}
+	dest := filepath.Join(dir, "dest")
+	if err := os.Mkdir(dest, 0755); err != nil {
+		t.Fatal(err)
+	}
+	p := newTestPair([]string{src}, dest)
+	p.wrapSender = func(conn net.Conn) net.Conn {
+		return &chunkHook{Conn: conn, hook: func(conn net.Conn, n int, payload []byte) (int, error) {
+			if n == 2 {
+				payload = append([]byte(nil), payload...)
+				payload[len(payload)/2] ^= 0xff
+			}
+			return conn.Write(payload)
+		}}
+	}
+	_, recvErr := p.run()
+	if !isErrorKind(recvErr, errTamperedChunk) {
+		t.Fatalf("receiving end should have rejected the chunk, got: %v", recvErr)
+	}
+}
+
+// replayHook wraps a connection and sends the first frame of type ft written to it again in
+// place of the second.
+type replayHook struct {
+	net.Conn
+	ft       byte
+	header   []byte // of a frame of type ft, held back until its payload is written
+	first    []byte
+	replayed bool
+}
+
+func (c *replayHook) Write(b []byte) (int, error) {
+	if c.header != nil {
+		frame := append(c.header, b...)
+		c.header = nil
+		if c.first == nil {
+			c.first = frame
+		} else if !c.replayed {
+			c.replayed = true
+			frame = c.first
+		}
+		if _, err := c.Conn.Write(frame); err != nil {
+			return 0, err
+		}
+		return len(b), nil
+	}
+	if len(b) == 5 && b[0] == c.ft {
+		c.header = append([]byte(nil), b...)
+		return len(b), nil
+	}
+	return c.Conn.Write(b)
+}
+
+func TestReplayedFrame(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src")
+	for _, name := range []string{"a.bin", "b.bin"} {
+		if _, err := writeRandomFile(filepath.Join(src, name), 1000); err != nil {
+			t.Fatal(err)
+		}
+	}
+	dest := filepath.Join(dir, "dest")
+	if err := os.Mkdir(dest, 0755); err != nil {
+		t.Fatal(err)
+	}
+	// someone on the network sends the first file's header again in place of the second's
+	p := newTestPair([]string{filepath.Join(src, "a.bin"), filepath.Join(src, "b.bin")}, dest)
+	p.wrapSender = func(conn net.Conn) net.Conn {
+		return &replayHook{Conn: conn, ft: frameHeader}
+	}
+	_, recvErr := p.run()
+	if !isErrorKind(recvErr, errTamperedChunk) || !strings.Contains(recvErr.Error(), "replayed") {
+		t.Fatalf("receiving end should have rejected the replayed header, got: %v", recvErr)
+	}
+	if _, err := os.Stat(filepath.Join(dest, "b.bin")); err == nil {
+		t.Fatal("second file was received despite the replayed header")
+	}
+}
+
+func TestMultiStream(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src")
+	sent := map[string][]byte{}
+	for name, size := range map[string]int{"empty.bin": 0, "big.bin": 5*CHUNKSIZE + 7, "small.txt": 10} {
+		data, err := writeRandomFile(filepath.Join(src, name), size)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sent[name] = data
+	}
+	dest := filepath.Join(dir, "dest")
+	if err := os.Mkdir(dest, 0755); err != nil {
+		t.Fatal(err)
+	}
+	p := newTestPair([]string{filepath.Join(src, "empty.bin"), filepath.Join(src, "big.bin"), filepath.Join(src, "small.txt")}, dest)
+	p.sender.Streams = 4
+	if err := checkBothSucceeded(p.run()); err != nil {
+		t.Fatal(err)
+	}
+	if !p.receiverUI.contains("Receiving over 4 streams") {
+		t.Fatal("receiving end didn't use the data streams")
+	}
+	for name, data := range sent {
+		if err := checkFile(filepath.Join(dest, name), data); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestSlowStream(t *testing.T) {
+	defer func(n int64) { maxReadAhead = n }(maxReadAhead)
+	maxReadAhead = 2
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src", "big.bin")
+	data, err := writeRandomFile(src, 12*CHUNKSIZE+100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dest := filepath.Join(dir, "dest")
+	if err = os.Mkdir(dest, 0755); err != nil {
+		t.Fatal(err)
+	}
+	// the first data stream stalls before its first chunk, so the others get ahead of it
+	p := newTestPair([]string{src}, dest)
+	p.sender.Streams = 3
+	conns := 0
+	p.wrapSender = func(conn net.Conn) net.Conn {
+		conns++
+		if conns != 2 {
+			return conn
+		}
+		return &chunkHook{Conn: conn, hook: func(conn net.Conn, n int, payload []byte) (int, error) {
+			if n == 1 {
+				time.Sleep(300 * time.Millisecond)
+			}
+			return conn.Write(payload)
+		}}
+	}
+	if err = checkBothSucceeded(p.run()); err != nil {
+		t.Fatal(err)
+	}
+	if err = checkFile(filepath.Join(dest, "big.bin"), data); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMultiStreamResume(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src", "big.bin")
+	data, err := writeRandomFile(src, 8*CHUNKSIZE+100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dest := filepath.Join(dir, "dest")
+	if err = os.Mkdir(dest, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	// cancel partway through chunk 3, once chunk 0 is through so there's something to resume
+	// from. the streams race each other, so which chunk a stream is on comes from the chunk.
+	p := newTestPair([]string{src}, dest)
+	p.sender.Streams = 3
+	firstSent := make(chan struct{})
+	p.wrapSender = func(conn net.Conn) net.Conn {
+		return &chunkHook{Conn: conn, hook: func(conn net.Conn, n int, payload []byte) (int, error) {
+			plaintext, err := decrypt(payload, p.sender.Key)
+			if err != nil {
+				return 0, err
+			}
+			switch binary.BigEndian.Uint64(plaintext) {
+			case 0:
+				defer close(firstSent)
+				return conn.Write(payload)
+			case 3:
+				<-firstSent
+			default:
+				return conn.Write(payload)
+			}
+			conn.Write(payload[:len(payload)/2])
+			p.sender.CancelCtx()
+			conn.Close()
+			return 0, errors.New("transfer was canceled")
+		}}
+	}
+	sendErr, recvErr := p.run()
+	if sendErr == nil {
+		t.Fatal("sending end didn't notice the cancellation")
+	}
+	if !isErrorKind(recvErr, errTruncatedStream) {
+		t.Fatalf("receiving end should have lost the connection, got: %v", recvErr)
+	}
+
+	p = newTestPair([]string{src}, dest)
+	p.sender.Streams = 3
+	if err = checkBothSucceeded(p.run()); err != nil {
+		t.Fatal(err)
+	}
+	if !p.receiverUI.contains("Resuming interrupted transfer") {
+		t.Fatal("second transfer started over instead of resuming")
+	}
+	if err = checkFile(filepath.Join(dest, "big.bin"), data); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCompression(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src")
+	if err := os.MkdirAll(src, 0755); err != nil {
+		t.Fatal(err)
+	}
+	var text bytes.Buffer
+	for i := 0; text.Len() < 2*CHUNKSIZE+CHUNKSIZE/2; i++ {
+		fmt.Fprintf(&text, "2024-05-01 12:00:%02d INFO request %d served in %dms\n", i%60, i, i%250)
+	}
+	// compresses to nothing, but the name says it's already compressed
+	photo := make([]byte, CHUNKSIZE+CHUNKSIZE/2)
+	sent := map[string][]byte{"log.txt": text.Bytes(), "photo.jpg": photo}
+	for name, data := range sent {
+		if err := ioutil.WriteFile(filepath.Join(src, name), data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, streams := range []int{1, 3} {
+		dest := filepath.Join(dir, fmt.Sprintf("dest%d", streams))
+		if err := os.Mkdir(dest, 0755); err != nil {
+			t.Fatal(err)
+		}
+		p := newTestPair([]string{filepath.Join(src, "log.txt"), filepath.Join(src, "photo.jpg")}, dest)
+		p.sender.Streams = streams
+		var wire int64
+		p.wrapSender = func(conn net.Conn) net.Conn {
+			return &chunkHook{Conn: conn, hook: func(conn net.Conn, n int, payload []byte) (int, error) {
+				atomic.AddInt64(&wire, int64(len(payload)))
+				return conn.Write(payload)
+			}}
+		}
+		if err := checkBothSucceeded(p.run()); err != nil {
+			t.Fatal(err)
+		}
+		for name, data := range sent {
+			if err := checkFile(filepath.Join(dest, name), data); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if wire < int64(len(photo)) {
+			t.Fatalf("%d streams: %d bytes on the wire, so the JPEG was compressed", streams, wire)
+		}
+		if wire > int64(len(photo)+text.Len()/4) {
+			t.Fatalf("%d streams: %d bytes on the wire, so the log wasn't compressed", streams, wire)
+		}
+		if !p.receiverUI.contains("Compression:") {
+			t.Fatal("compression ratio wasn't reported")
+		}
+	}
+}
@@ -0,0 +1,31 @@
+package main
+
+// UI is how the transfer engine tells the user what's happening. The wx window, the command
+// line, and anything embedding Flying Carpet each provide their own. Methods are called from
+// the transfer's goroutines, so implementations must be safe to call from any of them.
+type UI interface {
+	// Output is a line of log text.
+	Output(msg string)
+	// ShowPassword is called on the receiving end once the transfer password is generated.
+	ShowPassword(password string)
+	// ReviewFiles is called on the receiving end with everything the sending end is offering,
+	// and their total size, before any of it is sent. It returns whether to accept each entry.
+	// Entries past the end of the returned slice are declined.
+	ReviewFiles(entries []manifestEntry, totalSize int64) []bool
+	// ResolveConflict is called on the receiving end, if the user wants to be asked, for each
+	// accepted file that's already at path. It returns conflictRename, conflictOverwrite, or
+	// conflictSkip.
+	ResolveConflict(path string) conflictPolicy
+	// FileStarted is called as each file begins, with its path on this end.
+	FileStarted(path string)
+	// Progress is how far through the current file the transfer is, from 0 to 100.
+	Progress(percentage int)
+	// FileFinished is called once a file has been sent, or received and verified.
+	FileFinished(path string)
+	// TransferFinished is called last, with whatever ended the transfer early, or nil.
+	TransferFinished(err error)
+}
+
+func (t *Transfer) output(msg string) {
+	t.UI.Output(msg)
+}
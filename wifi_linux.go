@@ -0,0 +1,186 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/godbus/dbus/v5"
+	"io/ioutil"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Linux has more than one WiFi stack. NetworkManager is the usual one on desktops, but
+// minimal installs and embedded boards often run iwd or plain wpa_supplicant instead. Each
+// has a backend here, and whichever is running gets used.
+
+type wifiBackend interface {
+	name() string
+	startAdHoc(t *Transfer) error
+	joinAdHoc(t *Transfer) error
+	resetWifi(t *Transfer)
+	// currentConnection identifies the network the WiFi card is on, for resetWifi to restore
+	currentConnection() string
+	currentSSID() string
+	wifiInterface() string
+	ipAddress() string
+}
+
+// hostTools is how a backend runs commands, waits between retries, and looks up the WiFi
+// card's address. Tests give backends scripted ones, so they can be driven without a WiFi card.
+type hostTools struct {
+	runner commandRunner
+	sleep  func(time.Duration)
+	// ipv4 is iface's first IPv4 address, or "" if it doesn't have one
+	ipv4 func(iface string) string
+}
+
+func realHostTools() hostTools {
+	return hostTools{runner: shellRunner{}, sleep: time.Sleep, ipv4: interfaceIPv4}
+}
+
+// wifiProbe is what detectWifiBackend looks at to find the WiFi stack, and what it builds
+// the backend from. Tests give it fakes.
+type wifiProbe struct {
+	tools hostTools
+	// hasName reports whether a service is running on the system bus
+	hasName func(name string) bool
+	// bus connects to a service on the system bus
+	bus func(dest string) (func(path dbus.ObjectPath) dbusObject, error)
+	// where iwd keeps the passwords of known networks
+	iwdStateDir string
+	// where wpa_supplicant puts its control sockets, one per interface
+	wpaControlDirs []string
+}
+
+func systemProbe() wifiProbe {
+	return wifiProbe{
+		tools:          realHostTools(),
+		hasName:        busHasName,
+		bus:            systemBusObjects,
+		iwdStateDir:    "/var/lib/iwd",
+		wpaControlDirs: []string{"/run/wpa_supplicant", "/var/run/wpa_supplicant"},
+	}
+}
+
+// detectWifiBackend picks the backend for the WiFi stack that's running. NetworkManager is
+// checked first because it usually runs wpa_supplicant or iwd underneath.
+func detectWifiBackend(p wifiProbe) (wifiBackend, error) {
+	if p.hasName(nmDest) {
+		object, err := p.bus(nmDest)
+		if err != nil {
+			return nil, err
+		}
+		return nmBackend{p.tools, &networkManager{object: object}}, nil
+	}
+	if p.hasName(iwdDest) {
+		object, err := p.bus(iwdDest)
+		if err != nil {
+			return nil, err
+		}
+		return iwdBackend{p.tools, &iwdClient{object: object}, p.iwdStateDir}, nil
+	}
+	if iface, ctrl := findWpaSupplicant(p.wpaControlDirs); ctrl != "" {
+		return wpaBackend{hostTools: p.tools, iface: iface, ctrl: wpaSocket{path: ctrl}}, nil
+	}
+	return nil, errors.New("Could not find NetworkManager, iwd, or wpa_supplicant. One of them must be managing your WiFi card.")
+}
+
+// busHasName reports whether a service is running on the system bus.
+func busHasName(name string) bool {
+	conn, err := dbus.SystemBus()
+	if err != nil {
+		return false
+	}
+	var has bool
+	err = conn.BusObject().Call("org.freedesktop.DBus.NameHasOwner", 0, name).Store(&has)
+	return err == nil && has
+}
+
+// systemBusObjects connects to a service on the system bus.
+func systemBusObjects(dest string) (func(path dbus.ObjectPath) dbusObject, error) {
+	conn, err := dbus.SystemBus()
+	if err != nil {
+		return nil, fmt.Errorf("Could not connect to the system D-Bus: %s", err)
+	}
+	return func(path dbus.ObjectPath) dbusObject {
+		return busObject{conn.Object(dest, path)}
+	}, nil
+}
+
+// Without NetworkManager, nothing hands out addresses on the ad hoc network, so the backends
+// for the other stacks set them up themselves. The hosting end takes the address
+// NetworkManager would, since that's where a Linux peer will look for it.
+
+const hostedAddress = "10.42.0.1"
+const hostedDHCPRange = "10.42.0.10,10.42.0.254,1h"
+const dnsmasqPidFile = "/run/flyingcarpet-dnsmasq.pid"
+
+// how long to wait for the system's own DHCP client before running one
+const addressTimeout = 10
+
+// interfaceIPv4 is iface's first IPv4 address, or "" if it doesn't have one.
+func interfaceIPv4(iface string) string {
+	i, err := net.InterfaceByName(iface)
+	if err != nil {
+		return ""
+	}
+	addrs, err := i.Addrs()
+	if err != nil {
+		return ""
+	}
+	for _, a := range addrs {
+		if ipNet, ok := a.(*net.IPNet); ok && ipNet.IP.To4() != nil {
+			return ipNet.IP.String()
+		}
+	}
+	return ""
+}
+
+// hostAddresses gives this end the hosting address and, if dnsmasq is installed, hands out
+// addresses to peers that join.
+func (h hostTools) hostAddresses(t *Transfer, iface string) error {
+	if out, err := h.runner.Run("ip addr add " + hostedAddress + "/24 dev " + iface); err != nil && !strings.Contains(out, "File exists") {
+		return fmt.Errorf("Could not give %s the address %s: %s", iface, hostedAddress, strings.TrimSpace(out))
+	}
+	if _, err := h.runner.Run("command -v dnsmasq"); err != nil {
+		t.output("dnsmasq is not installed, so the other computer won't be given an address automatically.")
+		return nil
+	}
+	cmd := "dnsmasq --conf-file=/dev/null --port=0 --interface=" + iface + " --bind-interfaces --except-interface=lo" +
+		" --dhcp-range=" + hostedDHCPRange + " --pid-file=" + dnsmasqPidFile
+	if out, err := h.runner.Run(cmd); err != nil {
+		return fmt.Errorf("Could not start dnsmasq: %s", strings.TrimSpace(out))
+	}
+	return nil
+}
+
+// stopHosting undoes hostAddresses. It's harmless if this end wasn't hosting.
+func (h hostTools) stopHosting(iface string) {
+	if b, err := ioutil.ReadFile(dnsmasqPidFile); err == nil {
+		if pid, err := strconv.Atoi(strings.TrimSpace(string(b))); err == nil {
+			h.runner.Run("kill " + strconv.Itoa(pid))
+		}
+		os.Remove(dnsmasqPidFile)
+	}
+	h.runner.Run("ip addr del " + hostedAddress + "/24 dev " + iface)
+}
+
+// waitForAddress waits for iface to get an address from the network it joined, and runs a
+// DHCP client if nothing on the system does it.
+func (h hostTools) waitForAddress(t *Transfer, iface string) error {
+	for i := 0; i < addressTimeout; i++ {
+		if h.ipv4(iface) != "" {
+			return nil
+		}
+		h.sleep(time.Second)
+	}
+	t.output("Requesting an address on " + iface + "...")
+	h.runner.Run("dhcpcd -1 -4 -t 20 " + iface + " || udhcpc -n -q -t 10 -i " + iface + " || dhclient -1 " + iface)
+	if h.ipv4(iface) == "" {
+		return errors.New("Could not get an address on the ad hoc network. Please install dhcpcd, udhcpc, or dhclient.")
+	}
+	return nil
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/godbus/dbus/v5"
+	"net"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Tests for the Linux network setup code, run against fake NetworkManager, iwd, and
+// wpa_supplicant instead of the real ones.
+
+// fakeBus holds the objects of a fake D-Bus service.
+type fakeBus struct {
+	lock    sync.Mutex
+	objects map[dbus.ObjectPath]*fakeDBusObject
+	nextID  int
+	slept   time.Duration
+}
+
+type fakeDBusObject struct {
+	props   map[string]interface{}
+	methods map[string]func(args []interface{}) ([]interface{}, error)
+}
+
+func (f *fakeBus) object(path dbus.ObjectPath) dbusObject {
+	return fakeBusObject{f, path}
+}
+
+func (f *fakeBus) sleep(d time.Duration) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.slept += d
+}
+
+type fakeBusObject struct {
+	f    *fakeBus
+	path dbus.ObjectPath
+}
+
+func (o fakeBusObject) Call(method string, args []interface{}, results ...interface{}) error {
+	o.f.lock.Lock()
+	obj, ok := o.f.objects[o.path]
+	var handler func([]interface{}) ([]interface{}, error)
+	if ok {
+		handler = obj.methods[method]
+	}
+	o.f.lock.Unlock()
+	if handler == nil {
+		return fmt.Errorf("no method %s on %s", method, o.path)
+	}
+	out, err := handler(args)
+	if err != nil || len(results) == 0 {
+		return err
+	}
+	return dbus.Store(out, results...)
+}
+
+func (o fakeBusObject) Property(name string) (interface{}, error) {
+	o.f.lock.Lock()
+	defer o.f.lock.Unlock()
+	obj, ok := o.f.objects[o.path]
+	if !ok {
+		return nil, fmt.Errorf("no object %s", o.path)
+	}
+	v, ok := obj.props[name]
+	if !ok {
+		return nil, fmt.Errorf("no property %s on %s", name, o.path)
+	}
+	return v, nil
+}
+
+func newNetworkTestTransfer(mode, peer string) (*Transfer, *recordingUI) {
+	ui := &recordingUI{}
+	t := &Transfer{Mode: mode, Peer: peer, Passphrase: "test", SSID: "flyingCarpet_selftest", UI: ui}
+	t.Ctx, t.CancelCtx = context.WithCancel(context.Background())
+	return t, ui
+}
+
+// tools has a backend run commands with r and wait on r's clock.
+func (r *scriptedRunner) tools() hostTools {
+	return hostTools{runner: r, sleep: r.sleep}
+}
+
+func TestDetectWifiBackend(t *testing.T) {
+	dir := t.TempDir()
+	running := map[string]bool{nmDest: true, iwdDest: true}
+	fakes := map[string]func(dbus.ObjectPath) dbusObject{
+		nmDest:  newFakeNetworkManager().object,
+		iwdDest: newFakeIwd(dir).object,
+	}
+	p := wifiProbe{
+		hasName: func(name string) bool { return running[name] },
+		bus: func(dest string) (func(dbus.ObjectPath) dbusObject, error) {
+			return fakes[dest], nil
+		},
+		wpaControlDirs: []string{filepath.Join(dir, "missing"), dir},
+	}
+
+	// a wpa_supplicant that answers PING, with a P2P socket that should be skipped
+	for _, name := range []string{"p2p-dev-wlan0", "wlan0"} {
+		addr := &net.UnixAddr{Name: filepath.Join(dir, name), Net: "unixgram"}
+		conn, err := net.ListenUnixgram("unixgram", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		go func() {
+			buf := make([]byte, 64)
+			n, from, err := conn.ReadFromUnix(buf)
+			if err == nil && string(buf[:n]) == "PING" {
+				conn.WriteToUnix([]byte("PONG\n"), from)
+			}
+		}()
+	}
+
+	b, err := detectWifiBackend(p)
+	if err != nil || b.name() != "NetworkManager" {
+		t.Fatalf("expected NetworkManager to be preferred, got %v, %v", b, err)
+	}
+	if iface := b.wifiInterface(); iface != "wlan0" {
+		t.Fatalf("expected NetworkManager's WiFi interface wlan0, got %q", iface)
+	}
+	running[nmDest] = false
+	b, err = detectWifiBackend(p)
+	if err != nil || b.name() != "iwd" {
+		t.Fatalf("expected iwd without NetworkManager, got %v, %v", b, err)
+	}
+	if ssid := b.currentSSID(); ssid != "Home" {
+		t.Fatalf("expected iwd to be on Home, got %q", ssid)
+	}
+	running[iwdDest] = false
+	b, err = detectWifiBackend(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w, ok := b.(wpaBackend)
+	if !ok || w.iface != "wlan0" {
+		t.Fatalf("expected wpa_supplicant on wlan0, got %#v", b)
+	}
+	if reply, err := w.request("PING"); err != nil || reply != "PONG" {
+		t.Fatalf("expected PONG from the control socket, got %q, %v", reply, err)
+	}
+	p.wpaControlDirs = []string{filepath.Join(dir, "missing")}
+	if _, err := detectWifiBackend(p); err == nil {
+		t.Fatal("expected an error with no WiFi stack running")
+	}
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// A backend for wpa_supplicant on its own, driven through its control socket. See
+// https://w1.fi/wpa_supplicant/devel/ctrl_iface_page.html for the commands. Networks added
+// here aren't saved to wpa_supplicant's config file, so they're gone after it restarts.
+
+// how long to wait for wpa_supplicant to start the access point
+const wpaHostTimeout = 15
+
+// findWpaSupplicant returns a WiFi interface wpa_supplicant manages and its control socket,
+// found in one of controlDirs, or "" for both if it isn't running.
+func findWpaSupplicant(controlDirs []string) (iface, ctrl string) {
+	for _, dir := range controlDirs {
+		entries, err := ioutil.ReadDir(dir)
+		if err != nil {
+			continue
+		}
+		for _, e := range entries {
+			// P2P devices have their own sockets but can't host or join networks
+			if e.Mode()&os.ModeSocket == 0 || strings.HasPrefix(e.Name(), "p2p-dev-") {
+				continue
+			}
+			return e.Name(), filepath.Join(dir, e.Name())
+		}
+	}
+	return "", ""
+}
+
+// wpaSocket sends commands to wpa_supplicant's control socket. It's a commandRunner so tests
+// can script wpa_supplicant's replies.
+type wpaSocket struct {
+	path string
+}
+
+var wpaSocketCount int32
+
+func (s wpaSocket) Run(cmd string) (string, error) {
+	// wpa_supplicant replies to the address a command came from, so this end needs one too
+	local := filepath.Join(os.TempDir(), fmt.Sprintf("flyingcarpet-wpa-%d-%d", os.Getpid(), atomic.AddInt32(&wpaSocketCount, 1)))
+	conn, err := net.DialUnix("unixgram", &net.UnixAddr{Name: local, Net: "unixgram"}, &net.UnixAddr{Name: s.path, Net: "unixgram"})
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(local)
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	if _, err = conn.Write([]byte(cmd)); err != nil {
+		return "", err
+	}
+	reply := make([]byte, 4096)
+	n, err := conn.Read(reply)
+	if err != nil {
+		return "", err
+	}
+	return string(reply[:n]), nil
+}
+
+// wpaBackend sets up the ad hoc network with wpa_supplicant. Since nothing else hands out
+// addresses, it does that too: see hostAddresses and waitForAddress.
+type wpaBackend struct {
+	hostTools
+	iface string
+	ctrl  commandRunner
+}
+
+func (wpaBackend) name() string { return "wpa_supplicant" }
+
+// request sends cmd to wpa_supplicant and returns its reply, turning refusals into errors.
+func (w wpaBackend) request(cmd string) (string, error) {
+	// only the command's name goes in errors: SET_NETWORK commands carry the password
+	verb := strings.Fields(cmd)[0]
+	reply, err := w.ctrl.Run(cmd)
+	if err != nil {
+		return "", fmt.Errorf("wpa_supplicant %s failed: %s", verb, err)
+	}
+	reply = strings.TrimSpace(reply)
+	if reply == "FAIL" || strings.HasPrefix(reply, "UNKNOWN COMMAND") {
+		return "", fmt.Errorf("wpa_supplicant %s failed: %s", verb, reply)
+	}
+	return reply, nil
+}
+
+// addNetwork adds a network for t.SSID in the given mode: 0 to join it, 2 to host it.
+func (w wpaBackend) addNetwork(t *Transfer, mode int) (id string, err error) {
+	if id, err = w.request("ADD_NETWORK"); err != nil {
+		return
+	}
+	settings := []string{
+		"ssid " + hex.EncodeToString([]byte(t.SSID)),
+		"mode " + strconv.Itoa(mode),
+		"key_mgmt WPA-PSK",
+		"proto RSN",
+		"pairwise CCMP",
+		"group CCMP",
+		"psk \"" + t.Passphrase + t.Passphrase + "\"",
+	}
+	if mode == 2 {
+		settings = append(settings, "frequency 2412")
+	}
+	for _, s := range settings {
+		if _, err = w.request("SET_NETWORK " + id + " " + s); err != nil {
+			w.request("REMOVE_NETWORK " + id)
+			return "", err
+		}
+	}
+	return
+}
+
+// status is wpa_supplicant's STATUS reply as a map.
+func (w wpaBackend) status() map[string]string {
+	status := map[string]string{}
+	reply, err := w.request("STATUS")
+	if err != nil {
+		return status
+	}
+	for _, line := range strings.Split(reply, "\n") {
+		if kv := strings.SplitN(line, "=", 2); len(kv) == 2 {
+			status[kv[0]] = kv[1]
+		}
+	}
+	return status
+}
+
+// waitForNetwork checks every interval seconds, for up to timeout seconds, whether the card
+// is on t.SSID. wpa_supplicant keeps scanning for a selected network by itself in between.
+func (w wpaBackend) waitForNetwork(t *Transfer, timeout, interval int) (bool, error) {
+	for {
+		select {
+		case <-t.Ctx.Done():
+			return false, errors.New("Transfer was canceled.")
+		default:
+		}
+		if s := w.status(); s["wpa_state"] == "COMPLETED" && s["ssid"] == t.SSID {
+			return true, nil
+		}
+		if timeout <= 0 {
+			return false, nil
+		}
+		timeout -= interval
+		w.sleep(time.Second * time.Duration(interval))
+	}
+}
+
+func (w wpaBackend) startAdHoc(t *Transfer) error {
+	id, err := w.addNetwork(t, 2)
+	if err != nil {
+		return err
+	}
+	if _, err = w.request("SELECT_NETWORK " + id); err != nil {
+		return err
+	}
+	up, err := w.waitForNetwork(t, wpaHostTimeout, 1)
+	if err != nil {
+		return err
+	}
+	if !up {
+		return errors.New("Could not start ad hoc network " + t.SSID + ". Does your WiFi card support access point mode?")
+	}
+	if err = w.hostAddresses(t, w.iface); err != nil {
+		return err
+	}
+	t.output("Started ad hoc network " + t.SSID + ".")
+	return nil
+}
+
+func (w wpaBackend) joinAdHoc(t *Transfer) error {
+	id, err := w.addNetwork(t, 0)
+	if err != nil {
+		return err
+	}
+	if _, err = w.request("SELECT_NETWORK " + id); err != nil {
+		return err
+	}
+	joined, err := w.waitForNetwork(t, joinAdHocTimeout, 5)
+	if err != nil {
+		return errors.New("Exiting joinAdHoc, transfer was canceled.")
+	}
+	if !joined {
+		return errors.New("Could not find the ad hoc network within " + strconv.Itoa(joinAdHocTimeout) + " seconds.")
+	}
+	if err = w.waitForAddress(t, w.iface); err != nil {
+		return err
+	}
+	t.output("Joined ad hoc network " + t.SSID + ".")
+	return nil
+}
+
+// networks is wpa_supplicant's LIST_NETWORKS reply, one []string{id, ssid, bssid, flags} per network.
+func (w wpaBackend) networks() (networks [][]string) {
+	reply, err := w.request("LIST_NETWORKS")
+	if err != nil {
+		return nil
+	}
+	lines := strings.Split(reply, "\n")
+	for _, line := range lines[1:] { // header
+		if fields := strings.Split(line, "\t"); len(fields) == 4 {
+			networks = append(networks, fields)
+		}
+	}
+	return
+}
+
+func (w wpaBackend) resetWifi(t *Transfer) {
+	for _, n := range w.networks() {
+		if n[1] != t.SSID {
+			continue
+		}
+		if _, err := w.request("REMOVE_NETWORK " + n[0]); err != nil {
+			t.output("Error removing ad hoc network: " + err.Error())
+		}
+	}
+	w.stopHosting(w.iface)
+	if t.PreviousSSID != "" {
+		if _, err := w.request("SELECT_NETWORK " + t.PreviousSSID); err != nil {
+			t.output("Error rejoining previous network: " + err.Error())
+		}
+	}
+	// selecting a network disables all the others
+	if _, err := w.request("ENABLE_NETWORK all"); err != nil {
+		t.output(err.Error())
+	}
+}
+
+// the network's id, which is what it's selected by
+func (w wpaBackend) currentConnection() string {
+	for _, n := range w.networks() {
+		if strings.Contains(n[3], "[CURRENT]") {
+			return n[0]
+		}
+	}
+	return ""
+}
+
+func (w wpaBackend) currentSSID() string { return w.status()["ssid"] }
+
+func (w wpaBackend) wifiInterface() string { return w.iface }
+
+func (w wpaBackend) ipAddress() string { return w.ipv4(w.iface) }
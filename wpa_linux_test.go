@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/hex"
+	"testing"
+	"time"
+)
+
+// wpaStatus is a STATUS reply for a card on the given network.
+func wpaStatus(state, ssid string) string {
+	return "bssid=02:00:00:00:01:00\nssid=" + ssid + "\nmode=station\nwpa_state=" + state + "\n"
+}
+
+func TestWpaStartAdHoc(t *testing.T) {
+	ctrl := &scriptedRunner{script: []scriptedCommand{
+		{match: "ADD_NETWORK", output: "3\n"},
+		{match: "SET_NETWORK", output: "OK\n"},
+		{match: "SELECT_NETWORK 3", output: "OK\n"},
+		{match: "STATUS", output: wpaStatus("SCANNING", ""), times: 2},
+		{match: "STATUS", output: wpaStatus("COMPLETED", "flyingCarpet_selftest")},
+	}}
+	r := &scriptedRunner{script: []scriptedCommand{
+		{match: "ip addr add"},
+		{match: "command -v dnsmasq", output: "/usr/sbin/dnsmasq\n"},
+		{match: "dnsmasq --conf-file"},
+	}}
+	b := wpaBackend{hostTools: r.tools(), iface: "wlan0", ctrl: ctrl}
+	tr, _ := newNetworkTestTransfer("receiving", "linux")
+	if err := b.startAdHoc(tr); err != nil {
+		t.Fatal(err)
+	}
+	for _, cmd := range []string{
+		"SET_NETWORK 3 ssid " + hex.EncodeToString([]byte(tr.SSID)),
+		"SET_NETWORK 3 mode 2",
+		"SET_NETWORK 3 psk \"testtest\"",
+		"ip addr add 10.42.0.1/24 dev wlan0",
+		"--interface=wlan0",
+	} {
+		if ctrl.count(cmd)+r.count(cmd) != 1 {
+			t.Fatalf("expected %q to be sent once, sent %q and ran %q", cmd, ctrl.ran, r.ran)
+		}
+	}
+	if r.slept != 2*time.Second {
+		t.Fatalf("expected to wait 2s for the access point, waited %s", r.slept)
+	}
+}
+
+func TestWpaJoinAdHoc(t *testing.T) {
+	ctrl := &scriptedRunner{script: []scriptedCommand{
+		{match: "ADD_NETWORK", output: "3\n"},
+		{match: "SET_NETWORK", output: "OK\n"},
+		{match: "SELECT_NETWORK 3", output: "OK\n"},
+		{match: "STATUS", output: wpaStatus("SCANNING", ""), times: 3},
+		{match: "STATUS", output: wpaStatus("COMPLETED", "flyingCarpet_selftest")},
+	}}
+	// nothing on the system runs a DHCP client, so the address comes from the one we run
+	r := &scriptedRunner{script: []scriptedCommand{{match: "dhcpcd"}}}
+	tools := r.tools()
+	tools.ipv4 = func(iface string) string {
+		if r.count("dhcpcd -1 -4 -t 20 "+iface) > 0 {
+			return "10.42.0.57"
+		}
+		return ""
+	}
+	b := wpaBackend{hostTools: tools, iface: "wlan0", ctrl: ctrl}
+
+	tr, ui := newNetworkTestTransfer("sending", "linux")
+	if err := b.joinAdHoc(tr); err != nil {
+		t.Fatal(err)
+	}
+	if ctrl.count("SET_NETWORK 3 mode 0") != 1 {
+		t.Fatalf("expected to join as a station, sent %q", ctrl.ran)
+	}
+	if r.slept != (15+addressTimeout)*time.Second {
+		t.Fatalf("expected to wait 15s for the network and %ds for an address, waited %s", addressTimeout, r.slept)
+	}
+	if !ui.contains("Joined ad hoc network") {
+		t.Fatal("joining was not reported")
+	}
+}
+
+func TestWpaResetWifi(t *testing.T) {
+	const header = "network id / ssid / bssid / flags\n"
+	ctrl := &scriptedRunner{script: []scriptedCommand{
+		{match: "LIST_NETWORKS", output: header + "0\tHome\tany\t[CURRENT]\n", times: 1},
+		{match: "LIST_NETWORKS", output: header + "0\tHome\tany\t[DISABLED]\n1\tflyingCarpet_selftest\tany\t[CURRENT]\n"},
+		{match: "REMOVE_NETWORK 1", output: "OK\n"},
+		{match: "SELECT_NETWORK 0", output: "OK\n"},
+		{match: "ENABLE_NETWORK all", output: "OK\n"},
+	}}
+	r := &scriptedRunner{script: []scriptedCommand{{match: "ip addr del"}}}
+	b := wpaBackend{hostTools: r.tools(), iface: "wlan0", ctrl: ctrl}
+
+	tr, ui := newNetworkTestTransfer("receiving", "mac")
+	tr.PreviousSSID = b.currentConnection()
+	if tr.PreviousSSID != "0" {
+		t.Fatalf("expected current network 0, got %q", tr.PreviousSSID)
+	}
+	b.resetWifi(tr)
+	for _, cmd := range []string{"REMOVE_NETWORK 1", "SELECT_NETWORK 0", "ENABLE_NETWORK all"} {
+		if ctrl.count(cmd) != 1 {
+			t.Fatalf("expected %q to be sent once, sent %q", cmd, ctrl.ran)
+		}
+	}
+	if r.count("ip addr del 10.42.0.1/24 dev wlan0") != 1 {
+		t.Fatalf("expected the hosting address to be removed, ran %q", r.ran)
+	}
+	if len(ui.lines) != 0 {
+		t.Fatalf("unexpected output: %q", ui.lines)
+	}
+}
@@ -0,0 +1,18 @@
+//go:build !linux && !darwin
+// +build !linux,!darwin
+
+package main
+
+import "errors"
+
+var errXattrsUnsupported = errors.New("Extended attributes aren't supported on this system.")
+
+func listXattrs(path string) ([]xattr, error) {
+	return nil, errXattrsUnsupported
+}
+
+func setXattr(path, name string, value []byte) error {
+	return errXattrsUnsupported
+}
+
+func xattrAllowed(name string) bool { return true }
@@ -0,0 +1,54 @@
+//go:build linux || darwin
+// +build linux darwin
+
+package main
+
+import (
+	"bytes"
+	"runtime"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// listXattrs reads the extended attributes of the file at path that are worth copying.
+func listXattrs(path string) ([]xattr, error) {
+	size, err := unix.Listxattr(path, nil)
+	if err != nil || size == 0 {
+		return nil, err
+	}
+	names := make([]byte, size)
+	if size, err = unix.Listxattr(path, names); err != nil {
+		return nil, err
+	}
+	var xattrs []xattr
+	for _, name := range bytes.Split(names[:size], []byte{0}) {
+		if len(name) == 0 || !xattrAllowed(string(name)) {
+			continue
+		}
+		valueSize, err := unix.Getxattr(path, string(name), nil)
+		if err != nil {
+			continue
+		}
+		value := make([]byte, valueSize)
+		if valueSize, err = unix.Getxattr(path, string(name), value); err != nil {
+			continue
+		}
+		xattrs = append(xattrs, xattr{string(name), value[:valueSize]})
+	}
+	return xattrs, nil
+}
+
+func setXattr(path, name string, value []byte) error {
+	return unix.Setxattr(path, name, value, 0)
+}
+
+// xattrAllowed is whether an extended attribute is the file's own to copy. On Linux that's
+// the user namespace: the others hold security labels and ACLs that belong to this system.
+// On a Mac, the quarantine flag is this computer's business.
+func xattrAllowed(name string) bool {
+	if runtime.GOOS == "linux" {
+		return strings.HasPrefix(name, "user.")
+	}
+	return name != "com.apple.quarantine"
+}